@@ -0,0 +1,198 @@
+package ipc
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+)
+
+// authentication - used when the server has a pre-shared key or identity keys, it runs straight after the key exchange.
+// The pre-shared key is mixed into the encryption key so only a peer that knows it can read anything sent after the
+// key exchange. Each end then sends its identity key (if it has one) with a signature over the transcript of the
+// exchange, a man in the middle would have had to change the public keys in it so it can't pass for a pinned peer.
+
+const (
+	authIdentity = 1 // the auth message carries an identity key and signature
+
+	authServerLabel = "golang-ipc server"
+	authClientLabel = "golang-ipc client"
+)
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return "authentication failed: " + e.Reason + ": " + e.Err.Error()
+	}
+
+	return "authentication failed: " + e.Reason
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authenticates - whether the server authenticates connections
+func (conf *ServerConfig) authenticates() bool {
+	return conf.PSK != nil || conf.Identity != nil || len(conf.ClientKeys) > 0
+}
+
+// authenticates - whether the client needs the server to authenticate itself
+func (conf *ClientConfig) authenticates() bool {
+	return conf.PSK != nil || len(conf.ServerKeys) > 0
+}
+
+// authenticate - proves the server's identity to the client and checks the client's, transcript is the hash of the
+// key exchange.
+//
+// server: auth message, client: auth message, server: 0 = accepted, 1 = refused
+func (ss *Session) authenticate(transcript []byte) error {
+	conf := ss.server.conf
+
+	err := writeAuth(ss.conn, ss.enc, conf.Identity, authServerLabel, transcript)
+	if err != nil {
+		return errors.New("unable to send the server's identity")
+	}
+
+	pub, err := readAuth(ss.conn, ss.enc, authClientLabel, transcript)
+	if err != nil {
+		ss.conn.Write([]byte{1})
+		return &AuthError{Reason: "the client " + err.Error()}
+	}
+
+	if len(conf.ClientKeys) > 0 && !pinned(conf.ClientKeys, pub) {
+		ss.conn.Write([]byte{1})
+
+		if pub == nil {
+			return &AuthError{Reason: "the client didn't send an identity key"}
+		}
+		return &AuthError{Reason: "the client's identity key isn't trusted"}
+	}
+
+	_, err = ss.conn.Write([]byte{0})
+	if err != nil {
+		return errors.New("unable to send the authentication reply")
+	}
+
+	ss.peerKey = pub
+
+	return nil
+}
+
+// authenticate - checks the server's identity and proves the client's, see Session.authenticate
+func (c *Client) authenticate(transcript []byte) error {
+	pub, err := readAuth(c.conn, c.enc, authServerLabel, transcript)
+	if err != nil {
+		return &AuthError{Reason: "the server " + err.Error()}
+	}
+
+	if len(c.conf.ServerKeys) > 0 && !pinned(c.conf.ServerKeys, pub) {
+		if pub == nil {
+			return &AuthError{Reason: "the server didn't send an identity key"}
+		}
+		return &AuthError{Reason: "the server's identity key isn't trusted"}
+	}
+
+	err = writeAuth(c.conn, c.enc, c.conf.Identity, authClientLabel, transcript)
+	if err != nil {
+		return errors.New("unable to send the client's identity")
+	}
+
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(c.conn, reply)
+	if err != nil {
+		return errors.New("failed to receive the authentication reply")
+	}
+
+	if reply[0] != 0 {
+		return &AuthError{Reason: "the server refused the client"}
+	}
+
+	c.peerKey = pub
+
+	return nil
+}
+
+// writeAuth - sends the identity key and its signature, or nothing if there is no identity key
+//
+// byte 0-3   = length of the encrypted message
+// byte 4-    = encrypted: flags, then the public key (32 bytes) and signature (64 bytes) if flags has authIdentity
+func writeAuth(conn net.Conn, enc *encryption, identity ed25519.PrivateKey, label string, transcript []byte) error {
+	msg := []byte{0}
+	if identity != nil {
+		msg[0] = authIdentity
+		msg = append(msg, identity.Public().(ed25519.PublicKey)...)
+		msg = append(msg, ed25519.Sign(identity, authTranscript(label, transcript))...)
+	}
+
+	data := enc.seal(nil, msg)
+
+	_, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...))
+	return err
+}
+
+// readAuth - reads the other end's identity key and checks its signature, returns nil if it didn't send one.
+// the errors returned describe what's wrong with the other end.
+func readAuth(conn net.Conn, enc *encryption, label string, transcript []byte) (ed25519.PublicKey, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return nil, errors.New("closed the connection during authentication")
+	}
+
+	size := binary.BigEndian.Uint32(b)
+	if size > 1024 {
+		return nil, errors.New("sent an authentication message that isn't valid")
+	}
+
+	b = make([]byte, size)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return nil, errors.New("closed the connection during authentication")
+	}
+
+	_, msg, err := enc.open(b, 0)
+	if err != nil {
+		return nil, errors.New("has a different pre-shared key, or there is a man in the middle")
+	}
+
+	if len(msg) == 0 || msg[0]&authIdentity == 0 {
+		return nil, nil
+	}
+
+	if len(msg) != 1+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, errors.New("sent an identity that isn't valid")
+	}
+
+	pub := ed25519.PublicKey(msg[1 : 1+ed25519.PublicKeySize])
+	if !ed25519.Verify(pub, authTranscript(label, transcript), msg[1+ed25519.PublicKeySize:]) {
+		return nil, errors.New("sent a signature that doesn't match its identity key")
+	}
+
+	return pub, nil
+}
+
+// authTranscript - what each end signs, the transcript of the key exchange labelled with which end signed it
+// so a signature can't be sent back to the end that made it
+func authTranscript(label string, transcript []byte) []byte {
+	return transcriptHash([]byte(label), transcript)
+}
+
+func pinned(keys []ed25519.PublicKey, pub ed25519.PublicKey) bool {
+	if pub == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(keys, func(k ed25519.PublicKey) bool { return k.Equal(pub) })
+}
+
+// PeerKey - returns the identity key the client authenticated with, or nil if it didn't send one
+func (ss *Session) PeerKey() ed25519.PublicKey {
+	return ss.peerKey
+}
+
+// PeerKey - returns the identity key the server authenticated with, or nil if it didn't send one
+func (c *Client) PeerKey() ed25519.PublicKey {
+	return c.peerKey
+}
@@ -0,0 +1,153 @@
+package ipc
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub, priv
+}
+
+// connectFails - starts a server and a client that shouldn't be able to connect to it, returns the error the client gets
+func connectFails(t *testing.T, sconf *ServerConfig, cconf *ClientConfig) *AuthError {
+	t.Helper()
+
+	name := testName()
+
+	s, err := StartServer(name, sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	messages(s.ReadContext)
+
+	cconf.DisableReconnect = true
+	c, err := StartClient(name, cconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	m := waitFor(t, messages(c.ReadContext), func(m *Message) bool { return m.Err != nil || isStatus(Connected)(m) })
+	if m.Err == nil {
+		t.Fatal("the client connected")
+	}
+
+	var aerr *AuthError
+	if !errors.As(m.Err, &aerr) {
+		t.Fatalf("the client failed with %v", m.Err)
+	}
+
+	return aerr
+}
+
+func TestAuthPSK(t *testing.T) {
+	psk := []byte("pre-shared key")
+
+	t.Run("same", func(t *testing.T) {
+		s, sr, c, cr := start(t, &ServerConfig{Encryption: true, PSK: psk}, &ClientConfig{Encryption: true, PSK: psk})
+
+		exchange(t, c.Write, sr, "to server")
+		exchange(t, s.Write, cr, "to client")
+	})
+
+	t.Run("different", func(t *testing.T) {
+		connectFails(t, &ServerConfig{Encryption: true, PSK: psk}, &ClientConfig{Encryption: true, PSK: []byte("another key")})
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		connectFails(t, &ServerConfig{Encryption: true, PSK: psk}, &ClientConfig{Encryption: true})
+	})
+}
+
+func TestAuthIdentity(t *testing.T) {
+	serverPub, serverKey := newKey(t)
+	clientPub, clientKey := newKey(t)
+	otherPub, _ := newKey(t)
+
+	t.Run("pinned", func(t *testing.T) {
+		s, _, c, _ := start(t,
+			&ServerConfig{Encryption: true, Identity: serverKey, ClientKeys: []ed25519.PublicKey{otherPub, clientPub}},
+			&ClientConfig{Encryption: true, Identity: clientKey, ServerKeys: []ed25519.PublicKey{serverPub}})
+
+		if !c.PeerKey().Equal(serverPub) {
+			t.Fatal("the client doesn't have the server's identity key")
+		}
+		if !s.Sessions()[0].PeerKey().Equal(clientPub) {
+			t.Fatal("the server doesn't have the client's identity key")
+		}
+	})
+
+	t.Run("unpinned", func(t *testing.T) {
+		// any key is accepted when none are pinned
+		s, _, c, _ := start(t, &ServerConfig{Encryption: true, Identity: serverKey},
+			&ClientConfig{Encryption: true, Identity: clientKey})
+
+		if !c.PeerKey().Equal(serverPub) || !s.Sessions()[0].PeerKey().Equal(clientPub) {
+			t.Fatal("the identity keys weren't exchanged")
+		}
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		err := connectFails(t, &ServerConfig{Encryption: true, Identity: serverKey},
+			&ClientConfig{Encryption: true, ServerKeys: []ed25519.PublicKey{otherPub}})
+		if err.Reason != "the server's identity key isn't trusted" {
+			t.Fatalf("failed with %v", err)
+		}
+	})
+
+	t.Run("untrusted client", func(t *testing.T) {
+		err := connectFails(t, &ServerConfig{Encryption: true, ClientKeys: []ed25519.PublicKey{otherPub}},
+			&ClientConfig{Encryption: true, Identity: clientKey})
+		if err.Reason != "the server refused the client" {
+			t.Fatalf("failed with %v", err)
+		}
+	})
+
+	t.Run("client without a key", func(t *testing.T) {
+		connectFails(t, &ServerConfig{Encryption: true, ClientKeys: []ed25519.PublicKey{clientPub}}, &ClientConfig{Encryption: true})
+	})
+
+	t.Run("server doesn't authenticate", func(t *testing.T) {
+		connectFails(t, &ServerConfig{Encryption: true}, &ClientConfig{Encryption: true, ServerKeys: []ed25519.PublicKey{serverPub}})
+	})
+
+	t.Run("identity not asked for", func(t *testing.T) {
+		// the client's identity key is only sent to a server that authenticates
+		s, _, c, _ := start(t, &ServerConfig{Encryption: true}, &ClientConfig{Encryption: true, Identity: clientKey})
+
+		if c.PeerKey() != nil || s.Sessions()[0].PeerKey() != nil {
+			t.Fatal("an identity key was exchanged")
+		}
+	})
+}
+
+func TestAuthError(t *testing.T) {
+	err := &AuthError{Reason: "the client isn't allowed"}
+	if err.Error() != "authentication failed: the client isn't allowed" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+
+	cause := errors.New("uid 1000")
+	err = &AuthError{Reason: "the client isn't allowed", Err: cause}
+	if err.Error() != "authentication failed: the client isn't allowed: uid 1000" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Fatal("the underlying error isn't unwrapped")
+	}
+
+	var aerr *AuthError
+	if !errors.As(error(err), &aerr) || aerr != err {
+		t.Fatal("errors.As didn't find the AuthError")
+	}
+}
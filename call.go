@@ -0,0 +1,165 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+func newCallHandlers() *callHandlers {
+	return &callHandlers{m: make(map[int]CallHandler)}
+}
+
+func (h *callHandlers) set(msgType int, handler CallHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if handler == nil {
+		delete(h.m, msgType)
+	} else {
+		h.m[msgType] = handler
+	}
+}
+
+func (h *callHandlers) get(msgType int) CallHandler {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.m[msgType]
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("call to message type %d failed: %s", e.MsgType, e.Msg)
+}
+
+// call - sends the request and waits for the matching reply, ctx or the connection closing
+func (l *link) call(ctx context.Context, msgType int, request []byte) ([]byte, error) {
+	if l.proto == legacyVersion {
+		return nil, errors.New("calls can't be made to a version 2 peer")
+	}
+
+	reply := make(chan *Message, 1)
+
+	l.mu.Lock()
+	if l.pending == nil {
+		l.pending = make(map[uint32]chan *Message)
+	}
+	l.lastCall++
+	id := l.lastCall
+	l.pending[id] = reply
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.pending, id)
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.sent <- &Message{MsgType: msgType, Data: request, flags: flagRequest, callID: id}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, errors.New("the connection has been closed")
+	}
+
+	select {
+	case m := <-reply:
+		if m.Err != nil {
+			return nil, m.Err
+		}
+		if m.flags&flagReplyError != 0 {
+			return nil, &RemoteError{MsgType: msgType, Msg: string(m.Data)}
+		}
+
+		return m.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, errors.New("the connection has been closed")
+	}
+}
+
+// dispatchCall - passes replies to the waiting caller and runs the handler for requests.
+// returns false if the message isn't part of a call and should be delivered as normal
+func (l *link) dispatchCall(m *Message) bool {
+	switch {
+	case m.flags&flagReply != 0:
+		l.mu.Lock()
+		reply, ok := l.pending[m.callID]
+		l.mu.Unlock()
+
+		if ok {
+			select {
+			case reply <- m:
+			default: // a second reply to the same call
+			}
+		}
+
+		return true
+
+	case m.flags&flagRequest != 0:
+		l.running.add()
+		go l.handleCall(m)
+
+		return true
+	}
+
+	return false
+}
+
+func (l *link) handleCall(m *Message) {
+	defer l.running.done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	reply := &Message{MsgType: m.MsgType, flags: flagReply, callID: m.callID}
+
+	handler := l.handlers.get(m.MsgType)
+	if l.draining.Load() {
+		reply.flags |= flagReplyError
+		reply.Data = []byte(errShuttingDown.Error())
+	} else if handler == nil {
+		reply.flags |= flagReplyError
+		reply.Data = []byte(fmt.Sprintf("no handler for message type %d", m.MsgType))
+	} else {
+		data, err := handler(ctx, m)
+		if err != nil {
+			reply.flags |= flagReplyError
+			reply.Data = []byte(err.Error())
+		} else {
+			reply.Data = data
+		}
+	}
+
+	select {
+	case l.sent <- reply:
+	case <-l.done:
+		log.Println("unable to send reply, the connection has been closed")
+	}
+}
+
+// failCalls - ends every call waiting for a reply on a connection that has been lost
+func (l *link) failCalls(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, reply := range l.pending {
+		// the caller may have already gone, or have a reply waiting that it hasn't taken
+		select {
+		case reply <- &Message{Err: err}:
+		default:
+		}
+		delete(l.pending, id)
+	}
+}
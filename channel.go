@@ -0,0 +1,141 @@
+package ipc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// OpenChannel - opens a new channel to the server, the server receives it from AcceptChannel
+func (c *Client) OpenChannel() (*Channel, error) {
+	if c.status.get() != Connected {
+		return nil, errors.New(c.status.String())
+	}
+
+	st, err := c.openStream(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{st: st}, nil
+}
+
+// AcceptChannel - waits for the server to open a channel
+func (c *Client) AcceptChannel(ctx context.Context) (*Channel, error) {
+	select {
+	case st := <-c.accept:
+		return &Channel{st: st}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, errors.New("client has closed the connection")
+	}
+}
+
+// OpenChannel - opens a new channel to the client connected to the session
+func (ss *Session) OpenChannel() (*Channel, error) {
+	if ss.status.get() != Connected {
+		return nil, errors.New(ss.status.String())
+	}
+
+	st, err := ss.openStream(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Channel{st: st}, nil
+}
+
+// OpenChannel - opens a new channel to the connected client
+//
+// In MultiClient mode use Session.OpenChannel instead.
+func (s *Server) OpenChannel() (*Channel, error) {
+	if s.conf.MultiClient {
+		return nil, errors.New("server is in multi client mode, use Session.OpenChannel instead")
+	}
+
+	ss := s.current()
+	if ss == nil {
+		return nil, errors.New(s.status.String())
+	}
+
+	return ss.OpenChannel()
+}
+
+// AcceptChannel - waits for any client to open a channel, use ClientID to find which one it came from
+func (s *Server) AcceptChannel(ctx context.Context) (*Channel, error) {
+	select {
+	case st := <-s.accept:
+		return &Channel{st: st}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, errors.New("server has closed the connection")
+	}
+}
+
+// acceptStream - queues a channel opened by the other end, refusing it if too many are already waiting
+func (l *link) acceptStream(st *stream) {
+	select {
+	case l.accept <- st:
+	default:
+		l.removeStream(st.id)
+		l.queueFrame(&Message{MsgType: 0, flags: flagStream | flagStreamClose, streamID: st.id})
+		l.sendControl(controlStopStream, binary.BigEndian.AppendUint32(nil, st.id))
+	}
+}
+
+// Read - reads data sent by the other end, returns io.EOF once it has closed the channel and all the data has been read
+func (ch *Channel) Read(p []byte) (int, error) {
+	return ch.st.Read(p)
+}
+
+// Write - sends p to the other end, blocking while the other end has too much unread data
+func (ch *Channel) Write(p []byte) (int, error) {
+	return ch.st.Write(p)
+}
+
+// CloseWrite - tells the other end no more data will be written, the channel can still be read from
+func (ch *Channel) CloseWrite() error {
+	return ch.st.closeWrite()
+}
+
+// Close - closes the channel in both directions
+func (ch *Channel) Close() error {
+	return ch.st.Close()
+}
+
+// ClientID - the id of the session the channel belongs to (server only)
+func (ch *Channel) ClientID() int {
+	return ch.st.l.clientID
+}
+
+// LocalAddr - returns the name of the socket or pipe the channel was opened over
+func (ch *Channel) LocalAddr() net.Addr {
+	return Addr(ch.st.l.name)
+}
+
+// RemoteAddr - returns the name of the socket or pipe the channel was opened over
+func (ch *Channel) RemoteAddr() net.Addr {
+	return Addr(ch.st.l.name)
+}
+
+// SetDeadline - sets the read and write deadlines, see net.Conn
+func (ch *Channel) SetDeadline(t time.Time) error {
+	ch.st.setDeadlines(&t, &t)
+	return nil
+}
+
+// SetReadDeadline - sets the deadline for Read calls, see net.Conn
+func (ch *Channel) SetReadDeadline(t time.Time) error {
+	ch.st.setDeadlines(&t, nil)
+	return nil
+}
+
+// SetWriteDeadline - sets the deadline for Write calls, see net.Conn
+func (ch *Channel) SetWriteDeadline(t time.Time) error {
+	ch.st.setDeadlines(nil, &t)
+	return nil
+}
@@ -0,0 +1,150 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// channels opened from both ends carry their own data at the same time, in both directions
+func TestChannelMultiplex(t *testing.T) {
+	s, _, c, _ := start(t, &ServerConfig{}, &ClientConfig{})
+
+	type pair struct{ local, remote *Channel }
+	var pairs []pair
+	for i := range 4 {
+		open, accept := c.OpenChannel, s.AcceptChannel
+		if i%2 == 1 {
+			open, accept = s.OpenChannel, c.AcceptChannel
+		}
+
+		local, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		remote, err := accept(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pairs = append(pairs, pair{local, remote})
+	}
+
+	errs := make(chan error, 2*len(pairs))
+	transfer := func(w, r *Channel, data []byte) {
+		go func() {
+			_, err := w.Write(data)
+			if err == nil {
+				err = w.CloseWrite()
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+
+		go func() {
+			got, err := io.ReadAll(r)
+			if err == nil && !bytes.Equal(got, data) {
+				err = fmt.Errorf("received %d bytes that don't match the %d sent", len(got), len(data))
+			}
+			errs <- err
+		}()
+	}
+
+	for i, p := range pairs {
+		transfer(p.local, p.remote, bytes.Repeat([]byte{byte(i)}, streamWindow*3+i))
+		transfer(p.remote, p.local, bytes.Repeat([]byte{byte(i + 100)}, streamWindow*2+i))
+	}
+
+	for range 2 * len(pairs) {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a channel that isn't being read doesn't hold up messages or the other channels
+func TestChannelStalled(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{}, &ClientConfig{})
+
+	stalled, err := c.OpenChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := stalled.Write(make([]byte, 2*streamWindow))
+		blocked <- err
+	}()
+
+	select {
+	case err := <-blocked:
+		t.Fatalf("writing more than the window to a channel that isn't read returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	exchange(t, c.Write, sr, "to server")
+	exchange(t, s.Write, cr, "to client")
+
+	other, err := c.OpenChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Write([]byte("other"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 2 {
+		ch, err := s.AcceptChannel(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 5)
+		ch.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(ch, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) == "other" {
+			stalled.Close()
+			return
+		}
+	}
+
+	t.Fatal("the other channel wasn't accepted")
+}
+
+// the writer sends messages and control messages before the frames of streams and channels
+func TestFramePriority(t *testing.T) {
+	l := &link{sent: make(chan *Message, 4), frames: make(chan *Message, 4), done: make(chan struct{})}
+
+	l.frames <- &Message{MsgType: 1, flags: flagStream}
+	l.frames <- &Message{MsgType: 2, flags: flagStream}
+	l.sent <- &Message{MsgType: 3}
+	l.sent <- &Message{MsgType: 0}
+
+	var order []int
+	for range 4 {
+		m, ok := l.next()
+		if !ok {
+			t.Fatal("no message to send")
+		}
+		order = append(order, m.MsgType)
+	}
+
+	if fmt.Sprint(order) != "[3 0 1 2]" {
+		t.Fatalf("sent in the order %v", order)
+	}
+
+	close(l.done)
+	if _, ok := l.next(); ok {
+		t.Fatal("a message was sent after the connection was closed")
+	}
+}
@@ -1,26 +1,47 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"strings"
+	"syscall"
 )
 
 // StartClient - start the ipc client.
 // ipcName = is the name of the unix socket or named pipe that the client will try and connect to.
 func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
+	return StartClientContext(context.Background(), ipcName, config)
+}
+
+// StartClientContext - starts the ipc client, the client is closed once ctx is done.
+// Any attempt to connect is abandoned when ctx is done and messages that haven't been read by then are dropped,
+// use ReadContext with the same ctx to stop reading at the same time.
+func StartClientContext(ctx context.Context, ipcName string, config *ClientConfig) (*Client, error) {
 	err := checkIpcName(ipcName)
 	if err != nil {
 		return nil, err
 	}
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
 	cc := &Client{
-		Name:     ipcName,
-		status:   NotConnected,
-		received: make(chan *Message),
-		sent:     make(chan *Message),
+		Name: ipcName,
+		ctx:  ctx,
+		link: link{
+			received: make(chan *Message),
+			sent:     make(chan *Message),
+			frames:   make(chan *Message),
+			done:     make(chan struct{}),
+			handlers: newCallHandlers(),
+			controls: newControlHandlers(),
+			streamID: ^uint32(0), // ids go up in twos, so the first stream opened by the client is 1
+			accept:   make(chan *stream, acceptQueueSize),
+			name:     ipcName,
+		},
 	}
 
 	if config == nil {
@@ -38,109 +59,186 @@ func StartClient(ipcName string, config *ClientConfig) (*Client, error) {
 	if cc.conf.SocketBasePath == "" {
 		cc.conf.SocketBasePath = DefaultClientConfig.SocketBasePath
 	}
+	if cc.conf.Codec == nil {
+		cc.conf.Codec = DefaultClientConfig.Codec
+	}
+	cc.codec = cc.conf.Codec
+	cc.rekeyAt = cc.conf.Rekey
+	cc.compMin = cc.conf.CompressMin
+	if cc.compMin <= 0 {
+		cc.compMin = defaultCompressMin
+	}
+
+	if (cc.conf.authenticates() || cc.conf.Identity != nil) && !cc.conf.Encryption {
+		return nil, errors.New("authentication needs encryption to be turned on")
+	}
+
+	if cc.conf.Outbox != nil {
+		cc.outbox, err = newOutbox(*cc.conf.Outbox)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	go startClient(cc)
 
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				cc.Close()
+			case <-cc.done:
+			}
+		}()
+	}
+
 	return cc, nil
 }
 
 func startClient(c *Client) {
-	c.status = Connecting
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	c.status.set(Connecting)
+	c.notify(&Message{Status: c.status.String(), MsgType: -1})
 
 	err := c.dial()
 	if err != nil {
-		c.received <- &Message{Err: err, MsgType: -1}
+		if errors.Is(err, errGaveUp) {
+			c.giveUp()
+		}
+		c.notify(&Message{Err: err, MsgType: -1})
 		return
 	}
 
-	c.status = Connected
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	c.status.set(Connected)
+	c.notify(&Message{Status: c.status.String(), MsgType: -1})
 
 	go c.read()
 	go c.write()
+
+	c.flushOutbox()
 }
 
 func (c *Client) read() {
-	bLen := make([]byte, 4)
+	stop := c.startHeartbeat(c.conf.Heartbeat, c.conf.HeartbeatMisses, c.peerTimeout)
+	defer close(stop)
 
 	for {
-		res := c.readData(bLen)
-		if !res {
+		m, err := c.readMsg()
+		if err != nil {
+			c.readError(err)
 			break
 		}
 
-		mLen := bytesToInt(bLen)
-		msgRecvd := make([]byte, mLen)
-		res = c.readData(msgRecvd)
-		if !res {
+		if m == nil {
+			continue
+		}
+
+		if m.Err != nil {
+			// errors read by the client are final, so the connection is dropped and made again instead
+			c.conn.Close()
+			c.readError(fmt.Errorf("%w: %w", errBadFrame, m.Err))
 			break
 		}
 
-		if c.conf.Encryption {
-			msgFinal, err := decrypt(*c.enc.cipher, msgRecvd)
-			if err != nil {
-				break
-			}
+		if !c.inOrder(m) {
+			continue
+		}
 
-			if bytesToInt(msgFinal[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				c.received <- &Message{Data: msgFinal[4:], MsgType: bytesToInt(msgFinal[:4])}
-			}
-		} else {
-			if bytesToInt(msgRecvd[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				c.received <- &Message{Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
-			}
+		if c.dispatchCall(m) {
+			continue
 		}
+
+		c.notify(m)
 	}
 }
 
-func (c *Client) readData(buff []byte) bool {
-	_, err := io.ReadFull(c.conn, buff)
-	if err != nil {
-		if strings.Contains(err.Error(), "EOF") { // the connection has been closed by the client.
-			c.conn.Close()
-			if c.status != Closing || c.status == Closed {
-				go c.reconnect()
-			}
+// notify - passes a message to Read, gives up once the context the client was started with is done
+func (c *Client) notify(m *Message) {
+	select {
+	case c.received <- m:
+	case <-c.ctx.Done():
+		m.discard()
+	}
+}
+
+func (c *Client) readError(err error) {
+	if c.rel != nil {
+		c.rel.pause()
+	}
+	c.failCalls(errors.New("the connection has been lost"))
+	c.failStreams(errors.New("the connection has been lost"))
 
-			return false
+	if c.leaving.Load() && c.status.get() != Closing {
+		// the server closed the connection on purpose so there is nothing to reconnect to
+		c.conn.Close()
+		c.status.set(Closed)
+		c.notify(&Message{Status: c.status.String(), MsgType: -1})
+		c.notify(&Message{Err: errors.New("server has closed the connection"), MsgType: -2})
+
+		return
+	}
+
+	if strings.Contains(err.Error(), "EOF") || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, errBadFrame) || c.status.get() == Timeout { // the connection has been closed by the server.
+		c.conn.Close()
+		if c.status.get() == Closing || c.status.get() == Closed {
+			return
 		}
 
-		if c.status == Closing {
-			c.status = Closed
-			c.received <- &Message{Status: c.status.String(), MsgType: -1}
-			c.received <- &Message{Err: errors.New("client has closed the connection"), MsgType: -2}
+		if c.conf.DisableReconnect {
+			if !c.status.change(Disconnected, Closing, Closed) {
+				return
+			}
+			c.notify(&Message{Status: c.status.String(), MsgType: -1})
+			c.notify(&Message{Err: errors.New("the connection has been lost"), MsgType: -2})
 
-			return false
+			return
 		}
 
-		// other read error
-		return false
+		go c.reconnect()
+
+		return
+	}
+
+	if c.status.get() == Closing {
+		c.status.set(Closed)
+		c.notify(&Message{Status: c.status.String(), MsgType: -1})
+		c.notify(&Message{Err: errors.New("client has closed the connection"), MsgType: -2})
 	}
 
-	return true
+	// other read error
 }
 
 func (c *Client) reconnect() {
-	c.status = ReConnecting
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	if !c.status.change(ReConnecting, Closing, Closed) {
+		return
+	}
+	c.notify(&Message{Status: c.status.String(), MsgType: -1})
 	err := c.dial() // connect to the pipe
 	if err != nil {
 		if err.Error() == "timed out trying to connect" {
-			c.status = Timeout
-			c.received <- &Message{Status: c.status.String(), MsgType: -1}
-			c.received <- &Message{Err: errors.New("timed out trying to re-connect"), MsgType: -1}
+			c.status.set(Timeout)
+			c.notify(&Message{Status: c.status.String(), MsgType: -1})
+			c.notify(&Message{Err: errors.New("timed out trying to re-connect"), MsgType: -1})
+		} else if errors.Is(err, errGaveUp) {
+			c.giveUp()
+			c.notify(&Message{Status: c.status.String(), MsgType: -1})
+			c.notify(&Message{Err: err, MsgType: -2})
+		} else if c.status.change(Error, Closing, Closed) {
+			// the handshake failed, e.g. the server couldn't be authenticated
+			c.notify(&Message{Status: c.status.String(), MsgType: -1})
+			c.notify(&Message{Err: err, MsgType: -2})
 		}
 
 		return
 	}
 
-	c.status = Connected
-	c.received <- &Message{Status: c.status.String(), MsgType: -1}
+	c.status.set(Connected)
+	go c.flushOutbox()
+
+	status := c.status.get()
+	if c.resumed {
+		status = Resumed
+	}
+	c.notify(&Message{Status: status.String(), MsgType: -1})
 
 	go c.read()
 }
@@ -148,9 +246,21 @@ func (c *Client) reconnect() {
 // Read - blocking function that receices messages
 // if MsgType is a negative number its an internal message
 func (c *Client) Read() (*Message, error) {
-	m, ok := (<-c.received)
-	if !ok {
-		return nil, errors.New("the received channel has been closed")
+	return c.ReadContext(context.Background())
+}
+
+// ReadContext - the same as Read but returns ctx.Err() if ctx is done before a message is received
+func (c *Client) ReadContext(ctx context.Context) (*Message, error) {
+	var m *Message
+	var ok bool
+
+	select {
+	case m, ok = <-c.received:
+		if !ok {
+			return nil, errors.New("the received channel has been closed")
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	if m.Err != nil {
@@ -166,12 +276,72 @@ func (c *Client) Read() (*Message, error) {
 // Write - writes a  message to the ipc connection.
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
 func (c *Client) Write(msgType int, message []byte) error {
+	return c.WriteContext(context.Background(), msgType, message)
+}
+
+// WriteContext - the same as Write but returns ctx.Err() if ctx is done before the message could be queued
+func (c *Client) WriteContext(ctx context.Context, msgType int, message []byte) error {
+	if c.queueing() {
+		err := c.checkMessage(msgType, message)
+		if err != nil {
+			return err
+		}
+
+		return c.outbox.push(ctx, msgType, message, c.done)
+	}
+
+	err := c.checkWrite(msgType, message)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.sent <- &Message{MsgType: msgType, Data: message}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return errors.New(c.status.String())
+	}
+
+	return nil
+}
+
+// Call - sends a request to the server and waits for the reply from the handler registered for msgType.
+// returns a *RemoteError if the handler failed, or ctx.Err() if ctx is done before the reply arrives.
+func (c *Client) Call(ctx context.Context, msgType int, request []byte) ([]byte, error) {
+	err := c.checkWrite(msgType, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.call(ctx, msgType, request)
+}
+
+// HandleCall - registers the handler for calls made by the server to msgType, a nil handler removes it.
+func (c *Client) HandleCall(msgType int, handler CallHandler) {
+	c.handlers.set(msgType, handler)
+}
+
+func (c *Client) checkWrite(msgType int, message []byte) error {
+	if c.status.get() != Connected {
+		return errors.New(c.status.String())
+	}
+
+	if c.draining.Load() {
+		return errShuttingDown
+	}
+
+	return c.checkMessage(msgType, message)
+}
+
+// checkMessage - checks the message could be sent, whatever the state of the connection
+func (c *Client) checkMessage(msgType int, message []byte) error {
 	if msgType == 0 {
 		return errors.New("Message type 0 is reserved")
 	}
 
-	if c.status != Connected {
-		return errors.New(c.status.String())
+	if msgType < 0 || msgType > maxMsgType {
+		return errors.New("Message type is out of range")
 	}
 
 	mlen := len(message)
@@ -179,39 +349,29 @@ func (c *Client) Write(msgType int, message []byte) error {
 		return errors.New("Message exceeds maximum message length")
 	}
 
-	c.sent <- &Message{MsgType: msgType, Data: message}
-
 	return nil
 }
 
 func (c *Client) write() {
-	var err error
 	for {
-		m, ok := <-c.sent
+		m, ok := c.next()
 		if !ok {
-			break
+			return
 		}
 
-		toSend := intToBytes(m.MsgType)
-		writer := bufio.NewWriter(c.conn)
-
-		if c.conf.Encryption {
-			toSend = append(toSend, m.Data...)
-			toSend, err = encrypt(*c.enc.cipher, toSend)
-			if err != nil {
-				log.Println("error encrypting data", err)
+		if m.flushed != nil {
+			c.writeFrames()
+			close(m.flushed)
+			continue
+		}
 
-				continue
-			}
-		} else {
-			toSend = append(toSend, m.Data...)
+		if !c.sequence(m) {
+			return
 		}
 
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
-		err = writer.Flush()
+		err := c.writeMsg(m)
 		if err != nil {
-			log.Println("error flushing data", err)
+			log.Println("error sending data", err)
 
 			continue
 		}
@@ -220,14 +380,27 @@ func (c *Client) write() {
 
 // StatusCode - returns the current connection status
 func (c *Client) Status() Status {
-	return c.status
+	return c.status.get()
 }
 
 // Close - closes the connection
 func (c *Client) Close() {
-	c.status = Closing
+	if !c.status.change(Closing, Closing, Closed) {
+		return
+	}
 
-	if c.conn != nil {
-		c.conn.Close()
+	// a handshake could be setting the connection, it holds wmu until it has finished
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
 	}
+
+	if c.outbox != nil {
+		c.outbox.close()
+	}
+
+	c.doneOnce.Do(func() { close(c.done) })
 }
@@ -0,0 +1,120 @@
+package ipc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// JSONCodec - encodes payloads with encoding/json
+type JSONCodec struct{}
+
+// Name - returns "json"
+func (JSONCodec) Name() string { return "json" }
+
+// Marshal - encodes v as json
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal - decodes json data into v
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// GobCodec - encodes payloads with encoding/gob, each message is encoded on its own so carries its type information
+type GobCodec struct{}
+
+// Name - returns "gob"
+func (GobCodec) Name() string { return "gob" }
+
+// Marshal - encodes v as gob
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Unmarshal - decodes gob data into v
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ProtoCodec - encodes payloads with protocol buffers, values must implement proto.Message
+type ProtoCodec struct{}
+
+// Name - returns "proto"
+func (ProtoCodec) Name() string { return "proto" }
+
+// Marshal - encodes v, which must be a proto.Message
+func (ProtoCodec) Marshal(v any) ([]byte, error) {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+
+	return proto.Marshal(pm)
+}
+
+// Unmarshal - decodes data into v, which must be a proto.Message
+func (ProtoCodec) Unmarshal(data []byte, v any) error {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, pm)
+}
+
+// Send - encodes v with the connection's codec and writes it as msgType
+func Send[T any](w Sender, msgType int, v T) error {
+	data, err := w.Codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return w.Write(msgType, data)
+}
+
+// Decode - decodes the data of a received message with the codec of the connection it arrived on
+func Decode[T any](m *Message) (T, error) {
+	var v T
+
+	if m == nil {
+		return v, errors.New("message is nil")
+	}
+
+	codec := m.codec
+	if codec == nil {
+		codec = DefaultClientConfig.Codec
+	}
+
+	// protocol buffer messages are pointers, which need creating before they can be decoded into
+	if pm, ok := any(v).(proto.Message); ok {
+		v = pm.ProtoReflect().New().Interface().(T)
+
+		return v, codec.Unmarshal(m.Data, v)
+	}
+
+	return v, codec.Unmarshal(m.Data, &v)
+}
+
+// Codec - returns the codec used to encode payloads sent with Send, one of Codecs if the server is using it
+func (c *Client) Codec() Codec {
+	return c.codec
+}
+
+// Codec - returns the codec used to encode payloads sent with Send
+func (s *Server) Codec() Codec {
+	return s.conf.Codec
+}
+
+// Codec - returns the codec used to encode payloads sent with Send
+func (ss *Session) Codec() Codec {
+	return ss.codec
+}
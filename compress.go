@@ -0,0 +1,174 @@
+package ipc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression - the server offers the algorithms in ServerConfig.Compression during the handshake and the client
+// picks the first one it also has. Payloads of at least CompressMin bytes are then compressed before they are encrypted
+// and sent with flagCompressed set, unless compressing didn't make them any smaller. The receiver stops decompressing
+// once a payload is bigger than the maximum message size, so a small frame can't make it run out of memory. zstd frames
+// also say how much memory they need up front, decoders refuse frames asking for more than the maximum message size
+// and the encoder sends its frames as one segment, so the memory they ask for is their size.
+
+var errTooLarge = errors.New("decompressed message exceeds maximum message length")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithSingleSegment(true)) // EncodeAll can be called from any number of goroutines
+	zstdDecoders   sync.Map                                            // maximum message size -> *sync.Pool of decoders
+	gzipWriters    = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+)
+
+// zstdPool - decoders that refuse frames needing a window or more memory than limit
+func zstdPool(limit int) *sync.Pool {
+	p, ok := zstdDecoders.Load(limit)
+	if !ok {
+		size := uint64(max(limit, zstd.MinWindowSize))
+		p, _ = zstdDecoders.LoadOrStore(limit, &sync.Pool{New: func() any {
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+				zstd.WithDecoderMaxWindow(size), zstd.WithDecoderMaxMemory(size))
+			return d
+		}})
+	}
+
+	return p.(*sync.Pool)
+}
+
+// compressed - a copy of m with its data compressed, or m itself if compressing doesn't make it any smaller
+func (l *link) compressed(m *Message) *Message {
+	data, err := l.comp.compress(m.Data)
+	if err != nil || len(data) >= len(m.Data) {
+		return m
+	}
+
+	c := *m
+	c.Data = data
+	c.flags |= flagCompressed
+
+	return &c
+}
+
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, data), nil
+	case Gzip:
+		var b bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+
+		w.Reset(&b)
+		w.Write(data)
+		err := w.Close()
+
+		return b.Bytes(), err
+	}
+
+	return nil, errors.New("unknown compression")
+}
+
+// decompress - returns errTooLarge as soon as the data is more than limit bytes
+func (c Compression) decompress(data []byte, limit int) ([]byte, error) {
+	switch c {
+	case Zstd:
+		pool := zstdPool(limit)
+		d := pool.Get().(*zstd.Decoder)
+		defer pool.Put(d)
+
+		err := d.Reset(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		return readLimited(d, limit)
+	case Snappy:
+		n, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > limit {
+			return nil, errTooLarge
+		}
+
+		return s2.Decode(nil, data)
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		return readLimited(r, limit)
+	}
+
+	return nil, errors.New("received a compressed message but no compression was agreed on")
+}
+
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > limit {
+		return nil, errTooLarge
+	}
+
+	return b, nil
+}
+
+// compressOffer - the features entry listing the algorithms an end can use, in order of preference
+func compressOffer(algs []Compression) string {
+	names := make([]string, len(algs))
+	for i, c := range algs {
+		names[i] = c.String()
+	}
+
+	return compressPrefix + strings.Join(names, ",")
+}
+
+// takeCompression - removes the compression entry from a list of features and returns the first algorithm in it
+// that's also supported, 0 if there isn't one
+func takeCompression(list []string, supported []Compression) (Compression, []string) {
+	var chosen Compression
+	var rest []string
+	for _, f := range list {
+		offer, ok := strings.CutPrefix(f, compressPrefix)
+		if !ok {
+			rest = append(rest, f)
+			continue
+		}
+
+		for _, name := range strings.Split(offer, ",") {
+			i := slices.IndexFunc(supported, func(c Compression) bool { return c.String() == name })
+			if i != -1 && chosen == 0 {
+				chosen = supported[i]
+			}
+		}
+	}
+
+	return chosen, rest
+}
+
+func (c Compression) String() string {
+	switch c {
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	case Gzip:
+		return "gzip"
+	}
+
+	return "none"
+}
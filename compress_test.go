@@ -0,0 +1,147 @@
+package ipc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var algorithms = []Compression{Zstd, Snappy, Gzip}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("compress me ", 1000))
+
+	for _, alg := range algorithms {
+		t.Run(alg.String(), func(t *testing.T) {
+			b, err := alg.compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) >= len(data) {
+				t.Fatalf("compressed %d bytes to %d", len(data), len(b))
+			}
+
+			out, err := alg.decompress(b, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatal("decompressed data doesn't match")
+			}
+		})
+	}
+}
+
+// only payloads of at least CompressMin bytes that get smaller are sent compressed, the flag is set frame by frame
+func TestCompressFrames(t *testing.T) {
+	random := make([]byte, 2048)
+	rand.Read(random)
+
+	for _, alg := range algorithms {
+		t.Run(alg.String(), func(t *testing.T) {
+			for _, tc := range []struct {
+				name       string
+				data       []byte
+				compressed bool
+			}{
+				{"small", bytes.Repeat([]byte("a"), defaultCompressMin-1), false},
+				{"large", bytes.Repeat([]byte("a"), defaultCompressMin), true},
+				{"random", random, false},
+			} {
+				a, b := net.Pipe()
+				defer a.Close()
+				defer b.Close()
+
+				l := &link{conn: a, comp: alg, compMin: defaultCompressMin}
+				go l.writeMsg(&Message{MsgType: 5, Data: tc.data})
+
+				bLen := make([]byte, 4)
+				io.ReadFull(b, bLen)
+				frame := make([]byte, bytesToInt(bLen))
+				io.ReadFull(b, frame)
+
+				m, err := readHeader(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := m.flags&flagCompressed != 0; got != tc.compressed {
+					t.Fatalf("%s: compressed = %v, expected %v", tc.name, got, tc.compressed)
+				}
+				if tc.compressed {
+					m.Data, err = alg.decompress(m.Data, defaultMaxMsgSize)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !bytes.Equal(m.Data, tc.data) {
+					t.Fatalf("%s: received data that doesn't match", tc.name)
+				}
+			}
+		})
+	}
+}
+
+// payloads that decompress to more than the maximum message size are refused
+func TestCompressTooLarge(t *testing.T) {
+	data := make([]byte, 1<<20)
+
+	for _, alg := range algorithms {
+		t.Run(alg.String(), func(t *testing.T) {
+			b, err := alg.compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = alg.decompress(b, 1024)
+			if err == nil {
+				t.Fatal("a payload larger than the limit was decompressed")
+			}
+
+			_, err = alg.decompress(b, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// a zstd frame of a few bytes asking for a 512MB window is refused before the window is allocated
+func TestCompressBomb(t *testing.T) {
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x98, 0x09, 0x00, 0x00, 0x78}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err := Zstd.decompress(frame, 1024)
+	if err == nil {
+		t.Fatal("the frame was decompressed")
+	}
+
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20 {
+		t.Fatalf("decompressing the frame allocated %d bytes", n)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, alg := range algorithms {
+		t.Run(alg.String(), func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{Compression: []Compression{alg}}, &ClientConfig{Compression: algorithms})
+
+			for _, f := range []Features{c.NegotiatedFeatures(), s.Sessions()[0].NegotiatedFeatures()} {
+				if f.Compression != alg {
+					t.Fatalf("agreed on %s", f.Compression)
+				}
+			}
+
+			exchange(t, c.Write, sr, strings.Repeat("to server ", 1000))
+			exchange(t, s.Write, cr, strings.Repeat("to client ", 1000))
+			exchange(t, c.Write, sr, "small")
+		})
+	}
+}
@@ -36,7 +36,7 @@ func (s *Server) run() error {
 	s.listen = listen
 
 	go s.acceptLoop()
-	s.status = Listening
+	s.status.set(Listening)
 	//sc.received <- &Message{Status: sc.status.String(), MsgType: -1}
 	//sc.connChannel = make(chan bool)
 
@@ -47,11 +47,12 @@ func (s *Server) run() error {
 func (c *Client) dial() error {
 	socketPath := filepath.Join(c.conf.SocketBasePath, c.Name+defaultSocketExt)
 	startTime := time.Now()
+	attempt := 0
 
 	for {
 		if c.conf.Timeout != 0 {
 			if time.Since(startTime) > c.conf.Timeout {
-				c.status = Closed
+				c.status.set(Closed)
 				return errors.New("timed out trying to connect")
 			}
 		}
@@ -59,21 +60,27 @@ func (c *Client) dial() error {
 		conn, err := net.Dial("unix", socketPath)
 		if err != nil {
 			if strings.Contains(err.Error(), "connect: no such file or directory") {
+				err = nil
 			} else if strings.Contains(err.Error(), "connect: connection refused") {
+				err = nil
 			} else {
-				c.received <- &Message{Err: err, MsgType: -1}
+				c.notify(&Message{Err: err, MsgType: -1})
 			}
 		} else {
-			c.conn = conn
+			err = c.handshake(conn)
+			if err == nil {
+				return nil
+			}
 
-			err = c.handshake()
-			if err != nil {
+			if !errors.Is(err, errNoHandshake) {
 				return err
 			}
-
-			return nil
 		}
 
-		time.Sleep(c.conf.RetryTimer * time.Second)
+		attempt++
+		err = c.retry(attempt, err)
+		if err != nil {
+			return err
+		}
 	}
 }
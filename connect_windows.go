@@ -31,7 +31,7 @@ func (s *Server) run() error {
 	}
 
 	s.listen = listen
-	s.status = Listening
+	s.status.set(Listening)
 	go s.acceptLoop()
 
 	return nil
@@ -42,11 +42,12 @@ func (s *Server) run() error {
 func (c *Client) dial() error {
 	socketPath := filepath.Join(c.conf.SocketBasePath, c.Name)
 	startTime := time.Now()
+	attempt := 0
 
 	for {
 		if c.conf.Timeout != 0 {
 			if time.Since(startTime) > c.conf.Timeout {
-				c.status = Closed
+				c.status.set(Closed)
 				return errors.New("timed out trying to connect")
 			}
 		}
@@ -54,20 +55,25 @@ func (c *Client) dial() error {
 		pn, err := winio.DialPipe(socketPath, nil)
 		if err != nil {
 			if strings.Contains(err.Error(), "the system cannot find the file specified.") == true {
+				err = nil
 			} else {
 				return err
 			}
 		} else {
-			c.conn = pn
+			err = c.handshake(pn)
+			if err == nil {
+				return nil
+			}
 
-			err = c.handshake()
-			if err != nil {
+			if !errors.Is(err, errNoHandshake) {
 				return err
 			}
-
-			return nil
 		}
 
-		time.Sleep(c.conf.RetryTimer * time.Second)
+		attempt++
+		err = c.retry(attempt, err)
+		if err != nil {
+			return err
+		}
 	}
 }
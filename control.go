@@ -0,0 +1,239 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// control messages are sent with message type 0, the first byte of the data is the opcode and the rest depends on it.
+// opcodes below FirstAppControl are used by the package, the rest can be used by applications with HandleControl and SendControl.
+const (
+	controlCredit       byte = iota + 1 // stream id (4 bytes) + bytes read (4 bytes) - the receiver of a stream has read data
+	controlStopStream                   // stream id (4 bytes) - the receiver of a stream has stopped reading
+	controlPing                         // time sent (8 bytes) - the other end should reply with a pong
+	controlPong                         // the data from the ping being replied to
+	controlGoAway                       // no data - the other end is closing the connection on purpose and won't be back
+	controlRekey                        // step (1 byte) + public key - replaces the encryption key of the connection, see rekey.go
+	controlCapabilities                 // capability names separated by new lines - replaces the other end's capabilities
+	controlAck                          // sequence number (4 bytes) - every message up to it has been received (reliable delivery)
+	controlResume                       // sequence number (4 bytes) + epoch (8 bytes) + the other end's epoch (8 bytes) - the last message received, sent at the start of each connection (reliable delivery)
+	controlTicket                       // ticket length (2 bytes) + ticket + secret - a ticket the client can use to resume the session
+)
+
+// FirstAppControl - the first control opcode that applications can use
+const FirstAppControl byte = 0x80
+
+// sendControl - queues a control message to be sent
+func (l *link) sendControl(op byte, data []byte) error {
+	return l.queue(&Message{MsgType: 0, Data: append([]byte{op}, data...)})
+}
+
+// handleControl - acts on a control message received from the other end
+func (l *link) handleControl(m *Message) error {
+	if len(m.Data) == 0 {
+		return errors.New("received empty control message")
+	}
+
+	op, data := m.Data[0], m.Data[1:]
+
+	switch op {
+	case controlCredit:
+		if len(data) < 8 {
+			return errors.New("received invalid stream credit")
+		}
+
+		if st := l.stream(binary.BigEndian.Uint32(data)); st != nil {
+			st.addCredit(int(binary.BigEndian.Uint32(data[4:])))
+		}
+
+	case controlStopStream:
+		if len(data) < 4 {
+			return errors.New("received invalid stream stop")
+		}
+
+		if st := l.stream(binary.BigEndian.Uint32(data)); st != nil {
+			st.stop()
+		}
+
+	case controlPing:
+		// not from this goroutine, the write could wait for the other end to read
+		go l.writeMsg(&Message{MsgType: 0, Data: append([]byte{controlPong}, data...)})
+
+	case controlPong:
+		l.pong(data)
+
+	case controlGoAway:
+		l.leaving.Store(true)
+
+	case controlAck:
+		if len(data) < 4 || l.rel == nil {
+			return errors.New("received invalid ack")
+		}
+
+		l.rel.ack(binary.BigEndian.Uint32(data))
+
+	case controlResume:
+		if len(data) < 20 || l.rel == nil {
+			return errors.New("received invalid resume")
+		}
+
+		known := l.rel.restart(binary.BigEndian.Uint64(data[4:]), binary.BigEndian.Uint64(data[12:]))
+		go l.resume(binary.BigEndian.Uint32(data), known)
+
+	case controlTicket:
+		if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+			return errors.New("received invalid session ticket")
+		}
+
+		n := 2 + int(binary.BigEndian.Uint16(data))
+
+		l.mu.Lock()
+		l.ticket = data[2:n]
+		l.secret = data[n:]
+		l.mu.Unlock()
+
+	case controlCapabilities:
+		var caps []string
+		if len(data) > 0 {
+			caps = strings.Split(string(data), "\n")
+		}
+
+		l.mu.Lock()
+		l.peerCaps = caps
+		l.mu.Unlock()
+
+	default:
+		if op < FirstAppControl {
+			return nil // ignored so newer peers can add their own
+		}
+
+		if handler := l.controls.get(op); handler != nil {
+			handler(&Message{MsgType: 0, Data: data, ClientID: l.clientID})
+		}
+	}
+
+	return nil
+}
+
+func newControlHandlers() *controlHandlers {
+	return &controlHandlers{m: make(map[byte]ControlHandler)}
+}
+
+func (h *controlHandlers) set(op byte, handler ControlHandler) error {
+	if op < FirstAppControl {
+		return fmt.Errorf("control opcodes below %d are reserved", FirstAppControl)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if handler == nil {
+		delete(h.m, op)
+	} else {
+		h.m[op] = handler
+	}
+
+	return nil
+}
+
+func (h *controlHandlers) get(op byte) ControlHandler {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.m[op]
+}
+
+// sendAppControl - checks the opcode is an application one and sends it
+func (l *link) sendAppControl(op byte, data []byte) error {
+	if op < FirstAppControl {
+		return fmt.Errorf("control opcodes below %d are reserved", FirstAppControl)
+	}
+
+	return l.sendControl(op, data)
+}
+
+// updateCapabilities - sends the capabilities of this end to the other end, replacing any sent before
+func (l *link) updateCapabilities(caps []string) error {
+	for _, c := range caps {
+		if c == "" || strings.Contains(c, "\n") {
+			return fmt.Errorf("invalid capability %q", c)
+		}
+	}
+
+	return l.sendControl(controlCapabilities, []byte(strings.Join(caps, "\n")))
+}
+
+func (l *link) peerCapabilities() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.peerCaps...)
+}
+
+// HandleControl - registers the handler for an application control opcode (FirstAppControl or above), a nil handler removes it.
+// Handlers are called by the connection's read loop, so should return quickly.
+func (c *Client) HandleControl(op byte, handler ControlHandler) error {
+	return c.controls.set(op, handler)
+}
+
+// SendControl - sends an application control message to the server
+func (c *Client) SendControl(op byte, data []byte) error {
+	if c.status.get() != Connected {
+		return errors.New(c.status.String())
+	}
+
+	return c.sendAppControl(op, data)
+}
+
+// UpdateCapabilities - tells the server what this client is capable of, replacing anything sent before
+func (c *Client) UpdateCapabilities(caps ...string) error {
+	return c.updateCapabilities(caps)
+}
+
+// PeerCapabilities - returns the capabilities the server last sent
+func (c *Client) PeerCapabilities() []string {
+	return c.peerCapabilities()
+}
+
+// HandleControl - registers the handler for an application control opcode (FirstAppControl or above) sent by any client,
+// a nil handler removes it. Handlers are called by the connection's read loop, so should return quickly.
+func (s *Server) HandleControl(op byte, handler ControlHandler) error {
+	return s.controls.set(op, handler)
+}
+
+// SendControl - sends an application control message to the connected client
+//
+// In MultiClient mode use Session.SendControl instead.
+func (s *Server) SendControl(op byte, data []byte) error {
+	if s.conf.MultiClient {
+		return errors.New("server is in multi client mode, use Session.SendControl instead")
+	}
+
+	ss := s.current()
+	if ss == nil {
+		return errors.New(s.status.String())
+	}
+
+	return ss.SendControl(op, data)
+}
+
+// SendControl - sends an application control message to the client
+func (ss *Session) SendControl(op byte, data []byte) error {
+	if ss.status.get() != Connected {
+		return errors.New(ss.status.String())
+	}
+
+	return ss.sendAppControl(op, data)
+}
+
+// UpdateCapabilities - tells the client what the server is capable of, replacing anything sent before
+func (ss *Session) UpdateCapabilities(caps ...string) error {
+	return ss.updateCapabilities(caps)
+}
+
+// PeerCapabilities - returns the capabilities the client last sent
+func (ss *Session) PeerCapabilities() []string {
+	return ss.peerCapabilities()
+}
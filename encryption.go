@@ -3,145 +3,392 @@ package ipc
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ecdh"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"net"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func (sc *Server) keyExchange() ([32]byte, error) {
-	var shared [32]byte
+// keyExchange - agrees on the curve, cipher suite and key with the client. Also returns the hash of everything sent
+// during the exchange, which is what each end signs when the connection is authenticated.
+//
+// server: number of curves + curves, number of cipher suites + cipher suites (in order of preference)
+// client: curve + cipher suite (0 if there isn't one in common) + public key length (2 bytes) + public key
+// server: public key length (2 bytes) + public key
+func (ss *Session) keyExchange() (*encryption, []byte, error) {
+	conf := ss.server.conf
+	curves := orDefault(conf.Curves, defaultCurves)
+	suites := orDefault(conf.CipherSuites, defaultCipherSuites)
+
+	offer := []byte{byte(len(curves))}
+	for _, c := range curves {
+		offer = append(offer, byte(c))
+	}
+	offer = append(offer, byte(len(suites)))
+	for _, s := range suites {
+		offer = append(offer, byte(s))
+	}
 
-	priv, pub, err := generateKeys()
+	_, err := ss.conn.Write(offer)
 	if err != nil {
-		return shared, err
+		return nil, nil, errors.New("could not send the key exchange offer")
 	}
 
-	// send servers public key
-	err = sendPublic(sc.conn, pub)
+	choice := make([]byte, 4)
+	_, err = io.ReadFull(ss.conn, choice)
 	if err != nil {
-		return shared, err
+		return nil, nil, errors.New("didn't receive the client's key exchange")
 	}
 
-	// received clients public key
-	pubRecvd, err := recvPublic(sc.conn)
+	curve, suite := Curve(choice[0]), CipherSuite(choice[1])
+	if !slices.Contains(curves, curve) || !slices.Contains(suites, suite) {
+		return nil, nil, errors.New("client has no curve or cipher suite in common with the server")
+	}
+
+	clientPub := make([]byte, binary.BigEndian.Uint16(choice[2:]))
+	_, err = io.ReadFull(ss.conn, clientPub)
 	if err != nil {
-		return shared, err
+		return nil, nil, errors.New("didn't receive the client's public key")
 	}
 
-	b, _ := pubRecvd.Curve.ScalarMult(pubRecvd.X, pubRecvd.Y, priv.D.Bytes())
-	shared = sha256.Sum256(b.Bytes())
+	priv, err := generateKey(curve)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return shared, nil
-}
+	secret, err := sharedSecret(priv, clientPub)
+	if err != nil {
+		return nil, nil, err
+	}
 
-func (cc *Client) keyExchange() ([32]byte, error) {
-	var shared [32]byte
+	pub := priv.PublicKey().Bytes()
+	reply := binary.BigEndian.AppendUint16(nil, uint16(len(pub)))
+	reply = append(reply, pub...)
 
-	priv, pub, err := generateKeys()
+	_, err = ss.conn.Write(reply)
 	if err != nil {
-		return shared, err
+		return nil, nil, errors.New("could not send public key")
 	}
 
-	// received servers public key
-	pubRecvd, err := recvPublic(cc.conn)
+	transcript := transcriptHash(offer, choice, clientPub, reply)
+	enc, err := newEncryption(curve, suite, secret, conf.PSK, transcript, dirServer)
+
+	return enc, transcript, err
+}
+
+// keyExchange - agrees on the curve, cipher suite and key with the server, see Session.keyExchange
+func (cc *Client) keyExchange() (*encryption, []byte, error) {
+	var offer []byte
+	var lists [2][]byte
+	for i := range lists {
+		n := make([]byte, 1)
+		_, err := io.ReadFull(cc.conn, n)
+		if err != nil {
+			return nil, nil, errors.New("didn't receive the key exchange offer")
+		}
+
+		lists[i] = make([]byte, n[0])
+		_, err = io.ReadFull(cc.conn, lists[i])
+		if err != nil {
+			return nil, nil, errors.New("didn't receive the key exchange offer")
+		}
+
+		offer = append(append(offer, n...), lists[i]...)
+	}
+
+	curve := Curve(pick(lists[0], orDefault(cc.conf.Curves, defaultCurves)))
+	suite := CipherSuite(pick(lists[1], orDefault(cc.conf.CipherSuites, defaultCipherSuites)))
+	if curve == 0 || suite == 0 {
+		cc.conn.Write([]byte{0, 0, 0, 0})
+		return nil, nil, errors.New("server has no curve or cipher suite in common with the client")
+	}
+
+	priv, err := generateKey(curve)
 	if err != nil {
-		return shared, err
+		return nil, nil, err
 	}
 
-	// send clients public key
-	err = sendPublic(cc.conn, pub)
+	clientPub := priv.PublicKey().Bytes()
+	choice := []byte{byte(curve), byte(suite)}
+	choice = binary.BigEndian.AppendUint16(choice, uint16(len(clientPub)))
+
+	_, err = cc.conn.Write(append(slices.Clone(choice), clientPub...))
 	if err != nil {
-		return shared, err
+		return nil, nil, errors.New("could not send public key")
 	}
 
-	b, _ := pubRecvd.Curve.ScalarMult(pubRecvd.X, pubRecvd.Y, priv.D.Bytes())
-	shared = sha256.Sum256(b.Bytes())
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(cc.conn, reply)
+	if err != nil {
+		return nil, nil, errors.New("didn't receive public key")
+	}
 
-	return shared, nil
-}
+	reply = append(reply, make([]byte, binary.BigEndian.Uint16(reply))...)
+	_, err = io.ReadFull(cc.conn, reply[2:])
+	if err != nil {
+		return nil, nil, errors.New("didn't receive public key")
+	}
 
-func generateKeys() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
-	priva, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	secret, err := sharedSecret(priv, reply[2:])
 	if err != nil {
 		return nil, nil, err
 	}
 
-	puba := &priva.PublicKey
-	if !priva.IsOnCurve(puba.X, puba.Y) {
-		return nil, nil, errors.New("keys created arn't on curve")
+	transcript := transcriptHash(offer, choice, clientPub, reply)
+	enc, err := newEncryption(curve, suite, secret, cc.conf.PSK, transcript, dirClient)
+
+	return enc, transcript, err
+}
+
+func generateKey(curve Curve) (*ecdh.PrivateKey, error) {
+	c := curve.ecdh()
+	if c == nil {
+		return nil, errors.New("unknown curve")
 	}
 
-	return priva, puba, err
+	return c.GenerateKey(rand.Reader)
 }
 
-func sendPublic(conn net.Conn, pub *ecdsa.PublicKey) error {
-	pubSend := publicKeyToBytes(pub)
-	if pubSend == nil {
-		return errors.New("public key cannot be converted to bytes")
+func sharedSecret(priv *ecdh.PrivateKey, peerPub []byte) ([]byte, error) {
+	pub, err := priv.Curve().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, errors.New("didn't receive a valid public key")
 	}
 
-	_, err := conn.Write(pubSend)
+	return priv.ECDH(pub)
+}
+
+// newEncryption - derives the key from the shared secret with HKDF, the pre-shared key (if any) is the salt and the
+// transcript hash is bound into the key so the two ends only agree on it if they saw the same exchange.
+// dir is the direction of the frames this end sends.
+func newEncryption(curve Curve, suite CipherSuite, secret, psk, transcript []byte, dir byte) (*encryption, error) {
+	key, err := hkdf.Key(sha256.New, secret, psk, "golang-ipc key "+string(transcript), 32)
 	if err != nil {
-		return errors.New("could not sent public key")
+		return nil, err
 	}
 
-	return nil
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryption{curve: curve, suite: suite, sealer: *aead, opener: *aead, dir: dir}
+	e.keyed.Store(time.Now().UnixNano())
+
+	return e, nil
+}
+
+// seal - encrypts the next frame sent on the connection. Each direction numbers its frames from 0 and the nonce is
+// made from the direction and the sequence number, which are sent in the clear along with meta (the message type)
+// and authenticated as associated data so none of them can be changed.
+//
+// byte 0    = direction
+// byte 1-8  = sequence number
+// byte 9-   = meta followed by the ciphertext
+func (e *encryption) seal(meta, plain []byte) []byte {
+	if e.legacy {
+		return e.sealLegacy(meta, plain)
+	}
+
+	ad := append([]byte{e.dir}, binary.BigEndian.AppendUint64(nil, e.sent)...)
+	ad = append(ad, meta...)
+
+	frame := e.sealer.Seal(slices.Clone(ad), e.nonce(e.dir, e.sent), plain, ad)
+	e.sent++
+
+	e.frames.Add(1)
+	e.bytes.Add(int64(len(frame)))
+
+	return frame
 }
 
-func recvPublic(conn net.Conn) (*ecdsa.PublicKey, error) {
-	buff := make([]byte, 98)
-	i, err := conn.Read(buff)
+// open - decrypts the next frame received, metaLen is the length of the meta sent with it. Genuine frames that have
+// already been received, arrive out of order or came from this end return a *ReplayError.
+func (e *encryption) open(frame []byte, metaLen int) ([]byte, []byte, error) {
+	if e.legacy {
+		return e.openLegacy(frame, metaLen)
+	}
+
+	if len(frame) < 9+metaLen {
+		return nil, nil, errors.New("not enough data to decrypt")
+	}
+
+	ad := frame[:9+metaLen]
+	dir, seq := ad[0], binary.BigEndian.Uint64(ad[1:9])
+
+	plain, err := e.opener.Open(nil, e.nonce(dir, seq), frame[len(ad):], ad)
 	if err != nil {
-		return nil, errors.New("didn't received public key")
+		return nil, nil, err
+	}
+
+	if dir == e.dir {
+		return nil, nil, &ReplayError{Seq: seq, Expected: e.recv, Reflected: true}
+	}
+	if seq != e.recv {
+		return nil, nil, &ReplayError{Seq: seq, Expected: e.recv}
+	}
+	e.recv++
+
+	e.frames.Add(1)
+	e.bytes.Add(int64(len(frame)))
+
+	return ad[9:], plain, nil
+}
+
+func (e *encryption) nonce(dir byte, seq uint64) []byte {
+	nonce := make([]byte, e.sealer.NonceSize())
+	nonce[0] = dir
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+
+	return nonce
+}
+
+func (e *ReplayError) Error() string {
+	if e.Reflected {
+		return fmt.Sprintf("frame %d was sent by this end and reflected back to it", e.Seq)
 	}
 
-	if i != 97 {
-		return nil, errors.New("public key received isn't valid length")
+	if e.Seq < e.Expected {
+		return fmt.Sprintf("frame %d has already been received", e.Seq)
 	}
 
-	recvdPub := bytesToPublicKey(buff[:i])
-	if !recvdPub.IsOnCurve(recvdPub.X, recvdPub.Y) {
-		return nil, errors.New("didn't received valid public key")
+	return fmt.Sprintf("frame %d arrived out of order, expected %d", e.Seq, e.Expected)
+}
+
+func transcriptHash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
 	}
 
-	return recvdPub, nil
+	return h.Sum(nil)
 }
 
-func publicKeyToBytes(pub *ecdsa.PublicKey) []byte {
-	if pub == nil || pub.X == nil || pub.Y == nil {
-		return nil
+// pick - the first id offered that's also supported, or 0 if there isn't one
+func pick[T ~uint8](offered []byte, supported []T) byte {
+	for _, id := range offered {
+		if slices.Contains(supported, T(id)) {
+			return id
+		}
 	}
 
-	return elliptic.Marshal(elliptic.P384(), pub.X, pub.Y)
+	return 0
 }
 
-func bytesToPublicKey(recvdPub []byte) *ecdsa.PublicKey {
-	if len(recvdPub) == 0 {
-		return nil
+func orDefault[T any](list, def []T) []T {
+	if len(list) == 0 {
+		return def
 	}
 
-	x, y := elliptic.Unmarshal(elliptic.P384(), recvdPub)
-	return &ecdsa.PublicKey{Curve: elliptic.P384(), X: x, Y: y}
+	return list
 }
 
-func createCipher(shared [32]byte) (*cipher.AEAD, error) {
-	b, err := aes.NewCipher(shared[:])
-	if err != nil {
-		return nil, err
+func (c Curve) ecdh() ecdh.Curve {
+	switch c {
+	case X25519:
+		return ecdh.X25519()
+	case P256:
+		return ecdh.P256()
+	case P384:
+		return ecdh.P384()
+	}
+
+	return nil
+}
+
+func (c Curve) String() string {
+	switch c {
+	case X25519:
+		return "X25519"
+	case P256:
+		return "P-256"
+	case P384:
+		return "P-384"
+	}
+
+	return "none"
+}
+
+func (s CipherSuite) newAEAD(key []byte) (*cipher.AEAD, error) {
+	var aead cipher.AEAD
+	var err error
+
+	switch s {
+	case AES256GCM:
+		var b cipher.Block
+		b, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(b)
+		}
+	case ChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(key)
+	default:
+		err = errors.New("unknown cipher suite")
 	}
 
-	gcm, err := cipher.NewGCM(b)
 	if err != nil {
 		return nil, err
 	}
 
-	return &gcm, nil
+	return &aead, nil
+}
+
+func (s CipherSuite) String() string {
+	switch s {
+	case AES256GCM:
+		return "AES-256-GCM"
+	case ChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	}
+
+	return "none"
+}
+
+// CipherSuite - returns the cipher suite the connection is encrypted with, 0 if it isn't encrypted
+func (c *Client) CipherSuite() CipherSuite {
+	if c.enc == nil {
+		return 0
+	}
+
+	return c.enc.suite
+}
+
+// Curve - returns the curve used by the key exchange, 0 if the connection isn't encrypted
+func (c *Client) Curve() Curve {
+	if c.enc == nil {
+		return 0
+	}
+
+	return c.enc.curve
+}
+
+// CipherSuite - returns the cipher suite the connection is encrypted with, 0 if it isn't encrypted
+func (ss *Session) CipherSuite() CipherSuite {
+	if ss.enc == nil {
+		return 0
+	}
+
+	return ss.enc.suite
+}
+
+// Curve - returns the curve used by the key exchange, 0 if the connection isn't encrypted
+func (ss *Session) Curve() Curve {
+	if ss.enc == nil {
+		return 0
+	}
+
+	return ss.enc.curve
 }
 
+// encrypt - encrypts with a random nonce, only used for data that isn't sent as a frame on the connection (tickets)
 func encrypt(g cipher.AEAD, data []byte) ([]byte, error) {
 	nonce := make([]byte, g.NonceSize())
 	_, err := io.ReadFull(rand.Reader, nonce)
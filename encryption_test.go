@@ -0,0 +1,92 @@
+package ipc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	for _, suite := range []CipherSuite{AES256GCM, ChaCha20Poly1305} {
+		t.Run(suite.String(), func(t *testing.T) {
+			secret := make([]byte, 32)
+			client, err := newEncryption(X25519, suite, secret, nil, nil, dirClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := newEncryption(X25519, suite, secret, nil, nil, dirServer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var frames [3][]byte
+			for i := range frames {
+				frames[i] = client.seal([]byte{0, 0, 0, 5}, fmt.Appendf(nil, "frame %d", i))
+			}
+
+			open := func(frame []byte, want *ReplayError) {
+				t.Helper()
+
+				_, _, err := server.open(frame, 4)
+				if want == nil {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+
+				var re *ReplayError
+				if !errors.As(err, &re) || *re != *want {
+					t.Fatalf("got %v, expected %v", err, want)
+				}
+			}
+
+			open(frames[0], nil)
+			open(frames[0], &ReplayError{Seq: 0, Expected: 1})
+			open(frames[2], &ReplayError{Seq: 2, Expected: 1})
+			open(frames[1], nil)
+			open(server.seal([]byte{0, 0, 0, 5}, []byte("reflected")), &ReplayError{Seq: 0, Expected: 2, Reflected: true})
+			open(frames[2], nil)
+		})
+	}
+}
+
+// frames that are replayed or reflected on a live connection are dropped and reported, the connection carries on
+func TestReplayEvent(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{Encryption: true}, &ClientConfig{Encryption: true})
+	ss := s.Sessions()[0]
+
+	exchange(t, ss.Write, cr, "first")
+
+	// inject - writes a frame sealed by e to the client as if the server had sent it
+	inject := func(e *encryption, data string) {
+		m := &Message{MsgType: 5, Data: []byte(data)}
+		b := append(m.header(), m.Data...)
+		f := e.seal(b[:4], b[4:])
+
+		w := bufio.NewWriter(ss.conn)
+		w.Write(intToBytes(len(f)))
+		w.Write(f)
+		w.Flush()
+	}
+
+	ss.wmu.Lock()
+	replayed := &encryption{suite: ss.enc.suite, sealer: ss.enc.sealer, dir: ss.enc.dir, sent: ss.enc.sent - 1}
+	reflected := &encryption{suite: c.enc.suite, sealer: c.enc.sealer, dir: c.enc.dir}
+	inject(replayed, "replayed")
+	inject(reflected, "reflected")
+	ss.wmu.Unlock()
+
+	for _, want := range []bool{false, true} {
+		m := waitFor(t, cr, func(m *Message) bool { return m.Event != nil })
+
+		var re *ReplayError
+		if m.Event.Type != EventReplay || !errors.As(m.Event.Err, &re) || re.Reflected != want {
+			t.Fatalf("unexpected event %+v", m.Event)
+		}
+	}
+
+	exchange(t, ss.Write, cr, "after")
+	exchange(t, c.Write, sr, "to server")
+}
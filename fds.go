@@ -0,0 +1,145 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// descriptor passing - open files, sockets and memfds can be sent with a message over a unix socket (SCM_RIGHTS).
+// They're attached to the first byte of the frame they're sent with and the frame's header says how many there are,
+// so when the connection is encrypted the number is authenticated along with the frame and descriptors that arrive
+// with any other frame are refused. Over shared memory they're sent on the socket with a single byte and kept until
+// the frame that says it has them is read from the ring. Descriptors that aren't handed on to the application are
+// closed.
+
+var errNoFiles = errors.New("descriptors can only be sent over a unix socket to a peer that accepts them")
+
+// WriteWithFDs - writes a message with open files attached, the other end gets its own copies of them in
+// Message.Files. The files can be closed as soon as it returns. Only works over a unix socket.
+func (c *Client) WriteWithFDs(msgType int, message []byte, fds []*os.File) error {
+	if c.queueing() {
+		return errors.New("descriptors can't be kept in the outbox while the client is reconnecting")
+	}
+
+	err := c.checkWrite(msgType, message)
+	if err != nil {
+		return err
+	}
+
+	m, err := c.filesMessage(msgType, message, fds)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.sent <- m:
+	case <-c.done:
+		closeFiles(m.Files)
+		return errors.New(c.status.String())
+	}
+
+	return nil
+}
+
+// WriteWithFDs - writes a message with open files attached to the client connected to this session, see
+// Client.WriteWithFDs
+func (ss *Session) WriteWithFDs(msgType int, message []byte, fds []*os.File) error {
+	err := ss.checkWrite(msgType, message)
+	if err != nil {
+		return err
+	}
+
+	m, err := ss.filesMessage(msgType, message, fds)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ss.sent <- m:
+	case <-ss.done:
+		closeFiles(m.Files)
+		return errors.New(ss.status.String())
+	}
+
+	return nil
+}
+
+// WriteWithFDs - writes a message with open files attached, see Client.WriteWithFDs
+//
+// In MultiClient mode use Session.WriteWithFDs instead.
+func (s *Server) WriteWithFDs(msgType int, message []byte, fds []*os.File) error {
+	if s.conf.MultiClient {
+		return errors.New("server is in multi client mode, use Session.WriteWithFDs instead")
+	}
+
+	ss := s.current()
+	if ss == nil {
+		return errors.New(s.status.String())
+	}
+
+	return ss.WriteWithFDs(msgType, message, fds)
+}
+
+// filesMessage - a message carrying copies of the files. It isn't sent again after a reconnect,
+// the copies are closed once it has been written.
+func (l *link) filesMessage(msgType int, data []byte, files []*os.File) (*Message, error) {
+	if !l.hasFeature(FeatureFiles) {
+		return nil, errNoFiles
+	}
+
+	if len(files) > maxFiles {
+		return nil, errors.New("too many descriptors to send with one message")
+	}
+
+	dups, err := dupFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{MsgType: msgType, Data: data, Files: dups, flags: flagFiles}, nil
+}
+
+// sendFiles - writes a frame along with its descriptors
+func sendFiles(conn net.Conn, frame []byte, files []*os.File) error {
+	sc, ok := conn.(*shmConn)
+	if !ok {
+		return sendRights(conn, frame, files)
+	}
+
+	// the descriptors go first so they're on their way by the time the frame is read
+	err := sendRights(sc.Conn, []byte{0}, files)
+	if err != nil {
+		return err
+	}
+
+	_, err = sc.Write(frame)
+
+	return err
+}
+
+// takeFiles - the descriptors sent with a frame, received is what arrived with it on the socket
+func (l *link) takeFiles(m *Message, received []*os.File) ([]*os.File, error) {
+	n := 0
+	if m.flags&flagFiles != 0 {
+		n = int(m.fileCount)
+	}
+
+	if sc, ok := l.conn.(*shmConn); ok && n > 0 {
+		return sc.takeFiles(n)
+	}
+
+	if len(received) != n {
+		return nil, errors.New("received descriptors that don't match the message they were sent with")
+	}
+
+	return received, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux || darwin
+
+package ipc
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+var fdsTransports = []struct {
+	name         string
+	shm, encrypt bool
+}{
+	{"socket", false, false},
+	{"socket encrypted", false, true},
+	{"shm", true, false},
+	{"shm encrypted", true, true},
+}
+
+// expectClosed - fails the test unless every copy of the write end of the pipe r reads from has been closed
+func expectClosed(t *testing.T, r *os.File) {
+	t.Helper()
+
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := r.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("the write end of the pipe is still open: %v", err)
+	}
+}
+
+// the other end gets its own copies of the files, they still work once the sender has closed its own
+func TestWriteWithFDs(t *testing.T) {
+	for _, tc := range fdsTransports {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{SharedMemory: tc.shm, Encryption: tc.encrypt},
+				&ClientConfig{SharedMemory: tc.shm, Encryption: tc.encrypt})
+			if _, ok := c.conn.(*shmConn); ok != tc.shm {
+				t.Skip("shared memory isn't supported")
+			}
+
+			for _, dir := range []struct {
+				write    func(int, []byte, []*os.File) error
+				received chan *Message
+			}{
+				{c.WriteWithFDs, sr},
+				{s.WriteWithFDs, cr},
+			} {
+				r, w, err := os.Pipe()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+
+				err = dir.write(5, []byte("pipe"), []*os.File{w})
+				w.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				m := waitFor(t, dir.received, isMsg(5))
+				if string(m.Data) != "pipe" || len(m.Files) != 1 {
+					t.Fatalf("received %q with %d descriptors", m.Data, len(m.Files))
+				}
+
+				m.Files[0].Write([]byte("through the pipe"))
+				m.Files[0].Close()
+
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != "through the pipe" {
+					t.Fatalf("read %q from the pipe", got)
+				}
+			}
+
+			exchange(t, c.Write, sr, "without descriptors")
+		})
+	}
+}
+
+// the descriptors of a message that isn't handed on are closed, as are the copies made to send them
+func TestWriteWithFDsDropped(t *testing.T) {
+	for _, tc := range fdsTransports {
+		t.Run(tc.name, func(t *testing.T) {
+			name := testName()
+
+			// cancelled after the server has been closed, Close waits for its last messages to be read
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s, err := StartServer(name, &ServerConfig{SharedMemory: tc.shm, Encryption: tc.encrypt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			handled := make(chan struct{})
+			router := NewRouter(1)
+			router.HandleFunc(6, func(ctx context.Context, m *Message) { close(handled) })
+			go s.Serve(ctx, router)
+
+			c, err := StartClient(name, &ClientConfig{SharedMemory: tc.shm, Encryption: tc.encrypt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			waitFor(t, messages(c.ReadContext), isStatus(Connected))
+			if _, ok := c.conn.(*shmConn); ok != tc.shm {
+				t.Skip("shared memory isn't supported")
+			}
+
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			// nothing handles message type 5
+			err = c.WriteWithFDs(5, nil, []*os.File{w})
+			w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// messages are routed in order, so 5 has been dropped once 6 has been handled
+			c.Write(6, nil)
+			select {
+			case <-handled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the message wasn't handled")
+			}
+
+			expectClosed(t, r)
+		})
+	}
+}
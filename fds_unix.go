@@ -0,0 +1,134 @@
+//go:build linux || darwin
+
+package ipc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func filesSupported() bool {
+	return true
+}
+
+// readFiles - reads len(b) bytes from the connection and returns any descriptors that arrived with them
+func readFiles(conn net.Conn, b []byte) ([]*os.File, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		_, err := io.ReadFull(conn, b)
+		return nil, err
+	}
+
+	var files []*os.File
+	oob := make([]byte, unix.CmsgSpace(maxFiles*4))
+	for read := 0; read < len(b); {
+		n, oobn, flags, _, err := uc.ReadMsgUnix(b[read:], oob)
+		if oobn > 0 {
+			files = append(files, parseRights(oob[:oobn])...)
+		}
+
+		if err == nil && flags&unix.MSG_CTRUNC != 0 {
+			err = errors.New("received too many descriptors")
+		}
+
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+
+		read += n
+	}
+
+	return files, nil
+}
+
+func parseRights(oob []byte) []*os.File {
+	var files []*os.File
+	cmsgs, _ := unix.ParseSocketControlMessage(oob)
+	for _, cm := range cmsgs {
+		fds, err := unix.ParseUnixRights(&cm)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "ipc"))
+		}
+	}
+
+	return files
+}
+
+// sendRights - writes b with the descriptors attached to its first byte
+func sendRights(conn net.Conn, b []byte, files []*os.File) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errNoFiles
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fd, err := rawFd(f)
+		if err != nil {
+			return err
+		}
+
+		fds[i] = fd
+	}
+
+	n, _, err := uc.WriteMsgUnix(b, unix.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+
+	if n < len(b) {
+		_, err = uc.Write(b[n:])
+	}
+
+	return err
+}
+
+// dupFiles - copies of the files that are closed once they've been sent, so the caller can close its own straight away
+func dupFiles(files []*os.File) ([]*os.File, error) {
+	dups := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		fd, err := rawFd(f)
+		if err == nil {
+			fd, err = unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		}
+
+		if err != nil {
+			closeFiles(dups)
+			return nil, err
+		}
+
+		dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+	}
+
+	return dups, nil
+}
+
+// rawFd - the descriptor of a file, without putting it in blocking mode as Fd does
+func rawFd(f *os.File) (int, error) {
+	if f == nil {
+		return 0, errors.New("file is nil")
+	}
+
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	fd := -1
+	err = sc.Control(func(d uintptr) { fd = int(d) })
+
+	return fd, err
+}
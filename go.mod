@@ -4,8 +4,9 @@ go 1.25
 
 require (
 	github.com/Microsoft/go-winio v0.6.2
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.46.0
+	google.golang.org/protobuf v1.36.12
 )
 
-require (
-	golang.org/x/sys v0.39.0 // indirect
-)
+require golang.org/x/sys v0.39.0
@@ -4,49 +4,86 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 // 1st message sent from the server
-// byte 0 = protocal version no.
-// byte 1 = whether encryption is to be used - 0 no , 1 = encryption
-func (s *Server) handshake() error {
-	err := s.one()
+// byte 0 = 2 if version 2 clients can connect (they refuse anything but their own version), otherwise the oldest
+// protocol version the server speaks. The newest version both ends speak is agreed on with the features.
+// byte 1 = whether encryption is to be used - 0 no , 1 = encryption, 3 = encryption followed by authentication
+func (ss *Session) handshake() error {
+	err := ss.one()
 	if err != nil {
 		return err
 	}
 
-	if s.conf.Encryption {
-		err = s.startEncryption()
+	if ss.resumed {
+		return ss.restore()
+	}
+
+	if ss.server.conf.Encryption {
+		if ss.server.acceptsV2() {
+			ss.enc, err = legacyExchange(ss.conn, dirServer)
+		} else {
+			err = ss.startEncryption()
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	err = s.msgLength()
+	err = ss.msgLength()
 	if err != nil {
 		return err
 	}
 
+	if ss.proto == legacyVersion {
+		return nil // none of the optional features, see legacy.go
+	}
+
+	err = ss.startShm()
+	if err != nil {
+		return err
+	}
+
+	if ss.hasFeature(FeatureReliable) {
+		err = ss.startReliable(ss.server.reliable(ss))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *Server) one() error {
+func (ss *Session) one() error {
 	buff := make([]byte, 2)
-	buff[0] = byte(version)
+	buff[0] = byte(minVersion)
+	if ss.server.acceptsV2() {
+		buff[0] = legacyVersion
+	}
 
-	if s.conf.Encryption {
+	if ss.server.conf.Encryption {
 		buff[1] = byte(1)
+		if ss.server.conf.authenticates() {
+			buff[1] |= 2
+		}
 	} else {
 		buff[1] = byte(0)
 	}
 
-	_, err := s.conn.Write(buff)
+	_, err := ss.conn.Write(buff)
 	if err != nil {
 		return errors.New("unable to send handshake ")
 	}
 
 	recv := make([]byte, 1)
-	_, err = s.conn.Read(recv)
+	_, err = ss.conn.Read(recv)
 	if err != nil {
 		return errors.New("failed to received handshake reply")
 	}
@@ -60,42 +97,50 @@ func (s *Server) one() error {
 		return errors.New("client is enforcing encryption")
 	case 3:
 		return errors.New("server failed to get handshake reply")
-
+	case 4:
+		return ss.acceptTicket()
+	case 5:
+		return &AuthError{Reason: "the client requires authentication, the server has no pre-shared key or identity"}
 	}
 
 	return errors.New("other error - handshake failed")
 }
 
-func (s *Server) startEncryption() error {
-	shared, err := s.keyExchange()
+func (ss *Session) startEncryption() error {
+	enc, transcript, err := ss.keyExchange()
 	if err != nil {
 		return err
 	}
 
-	gcm, err := createCipher(shared)
-	if err != nil {
-		return err
-	}
+	ss.enc = enc
 
-	s.enc = &encryption{
-		keyExchange: "ecdsa",
-		encryption:  "AES-GCM-256",
-		cipher:      gcm,
+	if ss.server.conf.authenticates() {
+		return ss.authenticate(transcript)
 	}
 
 	return nil
 }
 
-func (s *Server) msgLength() error {
+// byte 0-3 = maximum message size
+// byte 4-  = name of the codec the server is using followed by the optional features it offers, separated by new lines
+//
+// the client replies with a result (0 = ok, 1 = different codec, 2 = no protocol version in common) followed by the
+// features it accepts, sealed like the rest of the handshake so neither can be changed on the way. When version 2
+// clients can connect that's preceded by the byte that tells them apart, see Session.upgrade.
+func (ss *Session) msgLength() error {
 	toSend := make([]byte, 4)
 	buff := make([]byte, 4)
-	binary.BigEndian.PutUint32(buff, uint32(s.conf.MaxMsgSize))
+	binary.BigEndian.PutUint32(buff, uint32(ss.server.conf.MaxMsgSize))
+	buff = append(buff, ss.server.conf.Codec.Name()...)
 
-	if s.conf.Encryption {
-		maxMsg, err := encrypt(*s.enc.cipher, buff)
-		if err != nil {
-			return err
-		}
+	offered := ss.server.features()
+	for _, f := range offered {
+		buff = append(buff, '\n')
+		buff = append(buff, f...)
+	}
+
+	if ss.server.conf.Encryption {
+		maxMsg := ss.enc.seal(nil, buff)
 
 		binary.BigEndian.PutUint32(toSend, uint32(len(maxMsg)))
 		toSend = append(toSend, maxMsg...)
@@ -104,57 +149,330 @@ func (s *Server) msgLength() error {
 		toSend = append(toSend, buff...)
 	}
 
-	_, err := s.conn.Write(toSend)
+	_, err := ss.conn.Write(toSend)
 	if err != nil {
 		return errors.New("unable to send max message length ")
 	}
 
-	reply := make([]byte, 1)
-	_, err = s.conn.Read(reply)
-	if err != nil {
+	if ss.server.acceptsV2() {
+		err = ss.upgrade()
+		if err != nil || ss.proto == legacyVersion {
+			return err
+		}
+	}
+
+	reply, err := readSealed(ss.conn, ss.enc, maxFeaturesSize)
+	if err != nil || len(reply) == 0 {
 		return errors.New("did not received message length reply")
 	}
 
+	switch reply[0] {
+	case 0:
+	case 1:
+		return errors.New("client is using a different codec")
+	case 2:
+		return errors.New("client has no protocol version in common with the server")
+	default:
+		return errors.New("other error - handshake failed")
+	}
+
+	var accepted []string
+	if len(reply) > 1 {
+		accepted = strings.Split(string(reply[1:]), "\n")
+	}
+
+	ss.proto, accepted = settle(accepted)
+	if ss.proto < minVersion {
+		return errors.New("client chose a protocol version the server doesn't speak")
+	}
+
+	ss.comp, accepted = takeCompression(accepted, ss.server.conf.Compression)
+	if ss.comp != 0 {
+		accepted = append(accepted, FeatureCompress)
+	}
+
+	ss.features = accepted
+
+	return nil
+}
+
+// features - the protocol versions and optional features offered to clients during the handshake
+func (s *Server) features() []string {
+	f := []string{versionsOffer(), FeatureMux, FeatureHeartbeat}
+	if s.conf.Reliable {
+		f = append(f, FeatureReliable)
+	}
+	if len(s.conf.Compression) > 0 {
+		f = append(f, compressOffer(s.conf.Compression))
+	}
+	if s.conf.SharedMemory && shmSupported() {
+		f = append(f, FeatureShm)
+	}
+	if filesSupported() {
+		f = append(f, FeatureFiles)
+	}
+
+	return f
+}
+
+// versionsOffer - the protocol versions this end speaks, sent along with the features
+func versionsOffer() string {
+	var v []string
+	for n := version; n >= minVersion; n-- {
+		v = append(v, strconv.Itoa(n))
+	}
+
+	return versionsPrefix + strings.Join(v, ",")
+}
+
+// settle - splits a list of features into the newest protocol version in its versions entry that this end speaks
+// (0 if there isn't one) and the rest of the features. Version 2 peers don't send a versions entry.
+func settle(list []string) (int, []string) {
+	var features []string
+	proto := legacyVersion
+	for _, f := range list {
+		offer, ok := strings.CutPrefix(f, versionsPrefix)
+		if !ok {
+			features = append(features, f)
+			continue
+		}
+
+		proto = 0
+		for _, v := range strings.Split(offer, ",") {
+			n, err := strconv.Atoi(v)
+			if err == nil && n >= minVersion && n <= version && n > proto {
+				proto = n
+			}
+		}
+	}
+
+	return proto, features
+}
+
+// reliable - returns the reliable delivery state for a new session, a single client or a client that has resumed
+// its session carries on where it left off once the session it was last connected to has stopped writing
+func (s *Server) reliable(ss *Session) *reliable {
+	if s.conf.MultiClient {
+		if ss.resuming != nil && ss.resuming.rel != nil {
+			return ss.resuming.rel // restore has already waited for the last session
+		}
+
+		return newReliable()
+	}
+
+	s.mu.Lock()
+	if s.rel == nil {
+		s.rel = newReliable()
+	}
+	prev := s.relOwner
+	s.relOwner = ss
+	s.mu.Unlock()
+
+	if prev != nil {
+		<-prev.stopped
+	}
+
+	return s.rel
+}
+
+// acceptFeatures - the features offered by the server that the client wants to use
+func (c *Client) acceptFeatures(offered []string) []string {
+	var f []string
+	for _, name := range offered {
+		switch name {
+		case FeatureMux, FeatureHeartbeat:
+			f = append(f, name)
+		case FeatureReliable:
+			if c.conf.Reliable {
+				f = append(f, name)
+			}
+		case FeatureShm:
+			if _, unix := c.conn.(*net.UnixConn); unix && c.conf.SharedMemory && shmSupported() {
+				f = append(f, name)
+			}
+		case FeatureFiles:
+			if _, unix := c.conn.(*net.UnixConn); unix && filesSupported() {
+				f = append(f, name)
+			}
+		}
+	}
+
+	return f
+}
+
+// hasFeature - whether both ends agreed to use the feature during the handshake
+func (l *link) hasFeature(name string) bool {
+	return slices.Contains(l.features, name)
+}
+
+// negotiated - the protocol version and features agreed on during the handshake
+func (l *link) negotiated() Features {
+	return Features{Version: l.proto, Names: slices.Clone(l.features), Compression: l.comp}
+}
+
+// NegotiatedFeatures - returns the protocol version and optional features agreed on with the server
+func (c *Client) NegotiatedFeatures() Features {
+	return c.negotiated()
+}
+
+// NegotiatedFeatures - returns the protocol version and optional features agreed on with the client
+func (ss *Session) NegotiatedFeatures() Features {
+	return ss.negotiated()
+}
+
+// Has - whether the feature was agreed on
+func (f Features) Has(name string) bool {
+	return slices.Contains(f.Names, name)
+}
+
+// writeSealed - writes a message sent during the handshake, encrypted when enc isn't nil
+//
+// byte 0-3 = length of the message
+// byte 4-  = the message
+func writeSealed(w io.Writer, enc *encryption, msg []byte) error {
+	_, err := w.Write(sealedFrame(enc, msg))
+	return err
+}
+
+func sealedFrame(enc *encryption, msg []byte) []byte {
+	if enc != nil {
+		msg = enc.seal(nil, msg)
+	}
+
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+// readSealed - reads a message written by writeSealed that is no longer than max
+func readSealed(r io.Reader, enc *encryption, max int) ([]byte, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return readSealedRest(r, enc, b, max)
+}
+
+// readSealedRest - reads the rest of a message written by writeSealed once its length has been read
+func readSealedRest(r io.Reader, enc *encryption, length []byte, max int) ([]byte, error) {
+	size := binary.BigEndian.Uint32(length)
+	if enc != nil {
+		max += enc.sealer.Overhead() + 9
+	}
+	if size > uint32(max) {
+		return nil, errors.New("handshake message is too long")
+	}
+
+	b := make([]byte, size)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if enc == nil {
+		return b, nil
+	}
+
+	_, msg, err := enc.open(b, 0)
+	return msg, err
+}
+
+// setConn - replaces the connection, it's set under mu as well as wmu so Close can read it without waiting for a handshake
+func (c *Client) setConn(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+}
+
+// handshake - sets up a new connection to the server, nothing else is written to it until the handshake has finished
+func (c *Client) handshake(conn net.Conn) error {
+	c.wmu.Lock()
+	c.setConn(conn)
+	err := c.exchange()
+	c.wmu.Unlock()
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if c.hasFeature(FeatureReliable) {
+		r := c.rel
+		if r == nil {
+			r = newReliable()
+		}
+
+		err = c.startReliable(r)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.rel = nil
+	}
+
 	return nil
 }
 
 // 1st message received by the client
-func (c *Client) handshake() error {
-	err := c.one()
+func (c *Client) exchange() error {
+	c.resumed = false
+	c.leaving.Store(false)
+
+	start, err := c.one()
 	if err != nil {
 		return err
 	}
 
+	if c.resumed {
+		return c.startShm() // the encryption and the features agreed on are carried over
+	}
+
+	// the server may speak version 2, or accept clients that do
+	compat := start == legacyVersion
+
 	if c.conf.Encryption {
-		err := c.startEncryption()
+		if compat {
+			c.enc, err = legacyExchange(c.conn, dirClient)
+		} else {
+			err = c.startEncryption()
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	err = c.msgLength()
+	err = c.msgLength(compat)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if c.proto == legacyVersion {
+		return nil // none of the optional features, see legacy.go
+	}
+
+	return c.startShm()
 }
 
-func (c *Client) one() error {
+// errNoHandshake - the server closed the connection without starting the handshake, it's busy with another client
+// or hasn't noticed the last connection has gone yet, so the client tries again
+var errNoHandshake = errors.New("failed to received handshake message")
+
+// one - returns the version the server started the handshake with
+func (c *Client) one() (byte, error) {
 	recv := make([]byte, 2)
 	_, err := c.conn.Read(recv)
 	if err != nil {
-		return errors.New("failed to received handshake message")
+		return 0, errNoHandshake
 	}
 
-	if recv[0] != version {
+	if recv[0] != legacyVersion && (recv[0] < minVersion || recv[0] > version) {
 		c.handshakeSendReply(1)
-		return errors.New("server has sent a different version number")
+		return 0, fmt.Errorf("server speaks protocol version %d, the client speaks %d to %d", recv[0], legacyVersion, version)
 	}
 
-	if recv[1] != 1 && c.conf.Encryption {
+	if recv[1]&1 == 0 && c.conf.Encryption {
 		c.handshakeSendReply(2)
-		return errors.New("server tried to connect without encryption")
+		return 0, errors.New("server tried to connect without encryption")
 	}
 
 	if recv[1] == 0 {
@@ -163,33 +481,44 @@ func (c *Client) one() error {
 		c.conf.Encryption = true
 	}
 
+	c.auth = recv[1]&2 != 0
+	if !c.auth && c.conf.authenticates() {
+		c.handshakeSendReply(5)
+		return 0, &AuthError{Reason: "the server doesn't authenticate itself"}
+	}
+
+	if c.ticket != nil {
+		c.resumed, err = c.presentTicket() // 4 is resume
+		return recv[0], err
+	}
+
+	c.enc = nil
 	c.handshakeSendReply(0) // 0 is ok
-	return nil
+	return recv[0], nil
 }
 
 func (c *Client) startEncryption() error {
-	shared, err := c.keyExchange()
+	enc, transcript, err := c.keyExchange()
 	if err != nil {
 		return err
 	}
 
-	gcm, err := createCipher(shared)
-	if err != nil {
-		return err
-	}
+	c.enc = enc
 
-	c.enc = &encryption{
-		keyExchange: "ECDSA",
-		encryption:  "AES-GCM-256",
-		cipher:      gcm,
+	c.peerKey = nil
+	if c.auth {
+		return c.authenticate(transcript)
 	}
 
 	return nil
 }
 
-func (c *Client) msgLength() error {
+// msgLength - reads the server's maximum message size, codec and features and replies with the features accepted.
+// compat is set when the server started the handshake as version 2, it's only a version 2 server if it doesn't
+// send a versions entry.
+func (c *Client) msgLength(compat bool) error {
 	buff := make([]byte, 4)
-	_, err := c.conn.Read(buff)
+	_, err := io.ReadFull(c.conn, buff)
 	if err != nil {
 		return errors.New("failed to received max message length 1")
 	}
@@ -198,13 +527,13 @@ func (c *Client) msgLength() error {
 	binary.Read(bytes.NewReader(buff), binary.BigEndian, &msgLen) // message length
 
 	buff = make([]byte, int(msgLen))
-	_, err = c.conn.Read(buff)
+	_, err = io.ReadFull(c.conn, buff)
 	if err != nil {
 		return errors.New("failed to received max message length 2")
 	}
 	var buff2 []byte
 	if c.conf.Encryption {
-		buff2, err = decrypt(*c.enc.cipher, buff)
+		_, buff2, err = c.enc.open(buff, 0)
 		if err != nil {
 			return errors.New("failed to received max message length 3")
 		}
@@ -216,11 +545,64 @@ func (c *Client) msgLength() error {
 	binary.Read(bytes.NewReader(buff2), binary.BigEndian, &maxMsgSize) // message length
 
 	c.conf.MaxMsgSize = int(maxMsgSize)
-	c.handshakeSendReply(0)
+	c.maxSize = c.conf.MaxMsgSize
+
+	trailer := strings.Split(string(buff2[4:]), "\n")
+	proto, offered := settle(trailer[1:])
+
+	if compat {
+		if proto == legacyVersion {
+			return c.legacy()
+		}
+
+		err = c.upgrade()
+		if err != nil {
+			return err
+		}
+	}
+
+	// servers that don't send their codec name aren't checked
+	c.codec = c.conf.Codec
+	if len(buff2) > 4 && trailer[0] != c.conf.Codec.Name() {
+		i := slices.IndexFunc(c.conf.Codecs, func(codec Codec) bool { return codec.Name() == trailer[0] })
+		if i == -1 {
+			c.negotiationReply(1, nil)
+			return fmt.Errorf("server is using the %s codec, client is using %s", trailer[0], c.conf.Codec.Name())
+		}
+
+		c.codec = c.conf.Codecs[i]
+	}
+
+	c.proto = proto
+	if c.proto < minVersion {
+		c.negotiationReply(2, nil)
+		return errors.New("server has no protocol version in common with the client")
+	}
+
+	c.comp, offered = takeCompression(offered, c.conf.Compression)
+	accepted := c.acceptFeatures(offered)
+
+	reply := append([]string{versionsPrefix + strconv.Itoa(c.proto)}, accepted...)
+	if c.comp != 0 {
+		reply = append(reply, compressOffer([]Compression{c.comp}))
+		accepted = append(accepted, FeatureCompress)
+	}
+
+	c.features = accepted
+
+	err = c.negotiationReply(0, reply)
+	if err != nil {
+		return errors.New("unable to send the accepted features")
+	}
 
 	return nil
 }
 
+// negotiationReply - replies to the server's codec and features, see Session.msgLength
+func (c *Client) negotiationReply(result byte, features []string) error {
+	return writeSealed(c.conn, c.enc, append([]byte{result}, strings.Join(features, "\n")...))
+}
+
 func (c *Client) handshakeSendReply(result byte) {
 	buff := make([]byte, 1)
 	buff[0] = result
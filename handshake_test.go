@@ -0,0 +1,61 @@
+package ipc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshakeFeatures(t *testing.T) {
+	s, _, c, _ := start(t, &ServerConfig{Reliable: true}, &ClientConfig{Reliable: true})
+
+	for _, f := range []Features{c.NegotiatedFeatures(), s.Sessions()[0].NegotiatedFeatures()} {
+		if f.Version != version {
+			t.Errorf("agreed on version %d, expected %d", f.Version, version)
+		}
+
+		for _, name := range []string{FeatureMux, FeatureHeartbeat, FeatureReliable} {
+			if !f.Has(name) {
+				t.Errorf("%s wasn't agreed on: %v", name, f.Names)
+			}
+		}
+	}
+}
+
+// the client's reply to the features offered is sealed, so it can't be read or changed on the way
+func TestHandshakeSealedReply(t *testing.T) {
+	secret := make([]byte, 32)
+	client, err := newEncryption(X25519, AES256GCM, secret, nil, nil, dirClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newEncryption(X25519, AES256GCM, secret, nil, nil, dirServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = writeSealed(&b, client, []byte("\x00"+FeatureReliable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b.Bytes(), []byte(FeatureReliable)) {
+		t.Fatal("the features were sent in the clear")
+	}
+
+	frame := b.Bytes()
+	tampered := bytes.Clone(frame)
+	tampered[len(tampered)-1] ^= 1
+	_, err = readSealed(bytes.NewReader(tampered), server, maxFeaturesSize)
+	if err == nil {
+		t.Fatal("a reply that was changed was accepted")
+	}
+
+	msg, err := readSealed(bytes.NewReader(frame), server, maxFeaturesSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "\x00"+FeatureReliable {
+		t.Fatalf("received %q", msg)
+	}
+}
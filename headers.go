@@ -3,6 +3,25 @@ package ipc
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+)
+
+const (
+	maxMsgType = 0x7fffffff // largest message type that can be sent, the top bit marks an extended header
+	extHeader  = 0x80000000 // set in the message type when the frame has an extended header
+)
+
+// extended header flags
+const (
+	flagRequest     uint16 = 1 << iota // the frame is a call waiting for a reply
+	flagReply                          // the frame is the reply to a call
+	flagReplyError                     // the reply data is the error returned by the handler
+	flagStream                         // the frame belongs to a stream
+	flagStreamOpen                     // the frame opens a new stream
+	flagStreamClose                    // the sender has finished writing to the stream
+	flagSeq                            // the frame has a sequence number (reliable delivery)
+	flagCompressed                     // the data is compressed with the algorithm agreed on during the handshake
+	flagFiles                          // descriptors were sent with the frame
 )
 
 func intToBytes(mLen int) []byte {
@@ -19,3 +38,98 @@ func bytesToInt(b []byte) int {
 
 	return int(mlen)
 }
+
+// header - returns the message type and, if there are any flags set, the extended header for the message.
+//
+// byte 0-3 = message type (top bit set when there is an extended header)
+// byte 4-5 = flags
+// then 4 bytes for the call id (calls and replies only)
+// then 4 bytes for the stream id (stream frames only)
+// then 4 bytes for the sequence number (reliable delivery only)
+// then 4 bytes for the number of descriptors sent with the frame (WriteWithFDs only)
+func (m *Message) header() []byte {
+	if m.flags == 0 {
+		return intToBytes(m.MsgType)
+	}
+
+	b := make([]byte, 6, 22)
+	binary.BigEndian.PutUint32(b, uint32(m.MsgType)|extHeader)
+	binary.BigEndian.PutUint16(b[4:], m.flags)
+
+	if m.flags&(flagRequest|flagReply) != 0 {
+		b = binary.BigEndian.AppendUint32(b, m.callID)
+	}
+
+	if m.flags&flagStream != 0 {
+		b = binary.BigEndian.AppendUint32(b, m.streamID)
+	}
+
+	if m.flags&flagSeq != 0 {
+		b = binary.BigEndian.AppendUint32(b, m.seq)
+	}
+
+	if m.flags&flagFiles != 0 {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(m.Files)))
+	}
+
+	return b
+}
+
+// readHeader - reads the header from the start of a received frame and returns the message with the remaining data
+func readHeader(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, errors.New("received message is too short")
+	}
+
+	t := binary.BigEndian.Uint32(b)
+	if t&extHeader == 0 {
+		return &Message{MsgType: int(t), Data: b[4:]}, nil
+	}
+
+	if len(b) < 6 {
+		return nil, errors.New("received message header is too short")
+	}
+
+	m := &Message{MsgType: int(t &^ extHeader), flags: binary.BigEndian.Uint16(b[4:])}
+	b = b[6:]
+
+	if m.flags&(flagRequest|flagReply) != 0 {
+		if len(b) < 4 {
+			return nil, errors.New("received message header is too short")
+		}
+
+		m.callID = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+
+	if m.flags&flagStream != 0 {
+		if len(b) < 4 {
+			return nil, errors.New("received message header is too short")
+		}
+
+		m.streamID = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+
+	if m.flags&flagSeq != 0 {
+		if len(b) < 4 {
+			return nil, errors.New("received message header is too short")
+		}
+
+		m.seq = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+
+	if m.flags&flagFiles != 0 {
+		if len(b) < 4 {
+			return nil, errors.New("received message header is too short")
+		}
+
+		m.fileCount = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+
+	m.Data = b
+
+	return m, nil
+}
@@ -0,0 +1,111 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// startHeartbeat - pings the other end every interval until the returned channel is closed.
+// dead is called if misses pings in a row go without a pong.
+func (l *link) startHeartbeat(interval time.Duration, misses int, dead func()) chan struct{} {
+	stop := make(chan struct{})
+
+	if interval <= 0 || !l.hasFeature(FeatureHeartbeat) {
+		return stop // the other end wouldn't answer
+	}
+
+	if misses <= 0 {
+		misses = defaultHeartbeatMisses
+	}
+
+	l.missed.Store(0)
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		var writing atomic.Bool // the last ping is still being written
+		for {
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			case <-l.done:
+				return
+			}
+
+			if int(l.missed.Load()) >= misses {
+				dead()
+				return
+			}
+
+			if writing.Load() {
+				l.missed.Add(1) // the other end hasn't read anything for a whole interval
+				continue
+			}
+
+			// counted before it's written as the pong can arrive before writeMsg returns, and taken back if it isn't sent
+			l.missed.Add(1)
+			writing.Store(true)
+			go func() {
+				defer writing.Store(false)
+
+				// written straight to the connection like acks, so it isn't held up behind the send queue
+				err := l.writeMsg(&Message{MsgType: 0, Data: binary.BigEndian.AppendUint64([]byte{controlPing}, uint64(time.Now().UnixNano()))})
+				if err != nil {
+					l.missed.Add(-1)
+				}
+			}()
+		}
+	}()
+
+	return stop
+}
+
+// pong - the other end has replied to a ping, data is the time the ping was sent
+func (l *link) pong(data []byte) {
+	if len(data) < 8 {
+		return
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+
+	l.rtt.Store(int64(time.Since(sent)))
+	l.missed.Store(0)
+}
+
+// Latency - returns the round trip time measured by the last heartbeat, 0 if heartbeats aren't enabled
+func (c *Client) Latency() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// Latency - returns the round trip time measured by the last heartbeat, 0 if heartbeats aren't enabled
+func (ss *Session) Latency() time.Duration {
+	return time.Duration(ss.rtt.Load())
+}
+
+// Latency - returns the round trip time to the connected client measured by the last heartbeat.
+// 0 if heartbeats aren't enabled or the server is in MultiClient mode, use Session.Latency instead.
+func (s *Server) Latency() time.Duration {
+	ss := s.current()
+	if ss == nil {
+		return 0
+	}
+
+	return ss.Latency()
+}
+
+// peerTimeout - the server has stopped answering heartbeats, closing the connection makes the client reconnect
+func (c *Client) peerTimeout() {
+	c.status.set(Timeout)
+	c.notify(&Message{Status: c.status.String(), MsgType: -1})
+	c.conn.Close()
+}
+
+// peerTimeout - the client has stopped answering heartbeats, the session is disconnected
+func (ss *Session) peerTimeout() {
+	ss.status.set(Timeout)
+	ss.server.notify(&Message{Status: ss.status.String(), MsgType: -1, ClientID: ss.ID})
+	ss.conn.Close()
+}
@@ -0,0 +1,123 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testID atomic.Int32
+
+// testName - a socket name that no other test uses
+func testName() string {
+	return fmt.Sprintf("ipc-test-%d-%d", os.Getpid(), testID.Add(1))
+}
+
+// messages - reads everything received until the connection is closed, so the reader never holds the connection up
+func messages(read func(context.Context) (*Message, error)) chan *Message {
+	ch := make(chan *Message, 4096)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			m, err := read(context.Background())
+			if err != nil {
+				if err.Error() == "the received channel has been closed" {
+					return
+				}
+
+				m = &Message{Err: err, MsgType: -1}
+			}
+
+			ch <- m
+		}
+	}()
+
+	return ch
+}
+
+// start - starts a server and a client connected to it, both are closed when the test finishes
+func start(t *testing.T, sconf *ServerConfig, cconf *ClientConfig) (*Server, chan *Message, *Client, chan *Message) {
+	t.Helper()
+
+	name := testName()
+
+	s, err := StartServer(name, sconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := messages(s.ReadContext)
+
+	c, err := StartClient(name, cconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := messages(c.ReadContext)
+
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	waitFor(t, cr, isStatus(Connected))
+	waitFor(t, sr, isStatus(Connected))
+
+	return s, sr, c, cr
+}
+
+// waitFor - the first message read from ch that match accepts, fails the test if it doesn't arrive in time
+func waitFor(t *testing.T, ch chan *Message, match func(*Message) bool) *Message {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				t.Fatal("the connection closed while waiting for a message")
+			}
+
+			if match(m) {
+				return m
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+// waitForTicket - the ticket the server gave the client and its secret
+func waitForTicket(t *testing.T, c *Client) ([]byte, []byte) {
+	t.Helper()
+
+	for range 500 {
+		c.mu.Lock()
+		ticket, secret := bytes.Clone(c.ticket), bytes.Clone(c.secret)
+		c.mu.Unlock()
+
+		if ticket != nil {
+			return ticket, secret
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the client wasn't given a ticket")
+	return nil, nil
+}
+
+func isStatus(status Status) func(*Message) bool {
+	return func(m *Message) bool {
+		return m.MsgType == -1 && m.Status == status.String()
+	}
+}
+
+func isMsg(msgType int) func(*Message) bool {
+	return func(m *Message) bool {
+		return m.MsgType == msgType
+	}
+}
@@ -0,0 +1,149 @@
+package ipc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// version 2 - the protocol spoken before the handshake had features. A version 2 client only accepts a server that
+// starts the handshake with its own version, so a server that can take them starts with 2 and sends its features
+// after the maximum message size, where version 2 clients ignore them. The reply to the maximum message size tells the
+// clients apart: version 2 clients reply 0, newer ones reply with their version and the handshake carries on as usual.
+// A server that doesn't send a versions entry is a version 2 server.
+//
+// When the connection is encrypted the version 2 key exchange comes first, the server can't know which kind of client
+// it has until the reply. Once a newer client has said so both ends make a new key with the current key exchange and
+// use it from then on, version 2 peers keep the version 2 key and its framing (see sealLegacy).
+//
+// Version 2 peers ignore control messages and can't read extended headers, so none of the optional features are used
+// with them and calls can't be made to them.
+
+// acceptsV2 - whether version 2 clients can connect, they can't authenticate
+func (s *Server) acceptsV2() bool {
+	return !s.conf.authenticates()
+}
+
+// upgrade - reads the reply to the maximum message size, which says whether the client speaks version 2
+func (ss *Session) upgrade() error {
+	reply := make([]byte, 1)
+	_, err := io.ReadFull(ss.conn, reply)
+	if err != nil {
+		return errors.New("did not received message length reply")
+	}
+
+	if reply[0] == 0 {
+		ss.proto = legacyVersion
+		return nil
+	}
+
+	if ss.server.conf.Encryption {
+		return ss.startEncryption() // replaces the version 2 key
+	}
+
+	return nil
+}
+
+// upgrade - tells a server that accepts version 2 clients that this one speaks a newer version
+func (c *Client) upgrade() error {
+	_, err := c.conn.Write([]byte{version})
+	if err != nil {
+		return errors.New("unable to send the protocol version")
+	}
+
+	if c.conf.Encryption {
+		return c.startEncryption() // replaces the version 2 key
+	}
+
+	return nil
+}
+
+// legacy - finishes the handshake with a version 2 server, it only waits for the reply to the maximum message size
+func (c *Client) legacy() error {
+	c.proto, c.features, c.comp = legacyVersion, nil, 0
+	c.codec = c.conf.Codec
+	c.handshakeSendReply(0)
+
+	return nil
+}
+
+// legacyExchange - the key exchange of version 2. Each end sends an uncompressed P-384 public key, the server first, and
+// the key is the SHA-256 of the shared secret without its leading zeros. dir is the direction of the frames this end
+// sends.
+func legacyExchange(conn net.Conn, dir byte) (*encryption, error) {
+	priv, err := generateKey(P384)
+	if err != nil {
+		return nil, err
+	}
+
+	pub := priv.PublicKey().Bytes()
+	peer := make([]byte, len(pub))
+
+	if dir == dirServer {
+		_, err = conn.Write(pub)
+		if err == nil {
+			_, err = io.ReadFull(conn, peer)
+		}
+	} else {
+		_, err = io.ReadFull(conn, peer)
+		if err == nil {
+			_, err = conn.Write(pub)
+		}
+	}
+	if err != nil {
+		return nil, errors.New("didn't receive public key")
+	}
+
+	secret, err := sharedSecret(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(bytes.TrimLeft(secret, "\x00"))
+	aead, err := AES256GCM.newAEAD(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryption{curve: P384, suite: AES256GCM, sealer: *aead, opener: *aead, dir: dir, legacy: true}
+	e.keyed.Store(time.Now().UnixNano())
+
+	return e, nil
+}
+
+// sealLegacy - encrypts a frame sent to a version 2 peer, meta is encrypted along with the rest of it
+//
+// byte 0-11 = random nonce
+// byte 12-  = meta followed by the data, encrypted
+func (e *encryption) sealLegacy(meta, plain []byte) []byte {
+	nonce := make([]byte, e.sealer.NonceSize())
+	rand.Read(nonce)
+
+	e.frames.Add(1)
+	frame := e.sealer.Seal(nonce, nonce, slices.Concat(meta, plain), nil)
+	e.bytes.Add(int64(len(frame)))
+
+	return frame
+}
+
+// openLegacy - decrypts a frame sent by a version 2 peer, they aren't numbered so replays can't be noticed
+func (e *encryption) openLegacy(frame []byte, metaLen int) ([]byte, []byte, error) {
+	plain, err := decrypt(e.opener, frame)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(plain) < metaLen {
+		return nil, nil, errors.New("not enough data to decrypt")
+	}
+
+	e.frames.Add(1)
+	e.bytes.Add(int64(len(frame)))
+
+	return plain[:metaLen], plain[metaLen:], nil
+}
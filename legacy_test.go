@@ -0,0 +1,325 @@
+//go:build linux || darwin
+
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// v2Peer - one end of a connection speaking version 2, written the way the package did before the handshake had
+// features
+type v2Peer struct {
+	t    *testing.T
+	conn net.Conn
+	gcm  cipher.AEAD // nil if the connection isn't encrypted
+}
+
+func socketPath(name string) string {
+	return filepath.Join(DefaultServerConfig.SocketBasePath, name+defaultSocketExt)
+}
+
+// dialV2 - connects to the server as a version 2 client
+func dialV2(t *testing.T, name string) *v2Peer {
+	t.Helper()
+
+	conn, err := net.Dial("unix", socketPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &v2Peer{t: t, conn: conn}
+
+	recv := p.readN(2)
+	if recv[0] != 2 {
+		conn.Write([]byte{1})
+		t.Fatalf("server started the handshake with version %d", recv[0])
+	}
+	conn.Write([]byte{0})
+
+	if recv[1] == 1 {
+		p.keyExchange(false)
+	}
+
+	msg := p.open(p.readN(bytesToInt(p.readN(4))))
+	if len(msg) < 4 {
+		t.Fatal("didn't receive the maximum message size")
+	}
+	conn.Write([]byte{0})
+
+	return p
+}
+
+// listenV2 - starts a version 2 server, the returned channel receives the first client to connect
+func listenV2(t *testing.T, name string, encrypted bool) chan *v2Peer {
+	t.Helper()
+
+	listen, err := net.Listen("unix", socketPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+
+	peers := make(chan *v2Peer, 1)
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		p := &v2Peer{t: t, conn: conn}
+
+		flag := byte(0)
+		if encrypted {
+			flag = 1
+		}
+		conn.Write([]byte{2, flag})
+		if reply := p.readN(1); reply[0] != 0 {
+			return
+		}
+
+		if encrypted {
+			p.keyExchange(true)
+		}
+
+		msg := p.seal(intToBytes(defaultMaxMsgSize))
+		conn.Write(append(intToBytes(len(msg)), msg...))
+		p.readN(1)
+
+		peers <- p
+	}()
+
+	return peers
+}
+
+// keyExchange - the P-384 key exchange of version 2, the server sends its public key first
+func (p *v2Peer) keyExchange(server bool) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	pub := elliptic.Marshal(elliptic.P384(), priv.X, priv.Y)
+
+	var peer []byte
+	if server {
+		p.conn.Write(pub)
+		peer = p.readN(97)
+	} else {
+		peer = p.readN(97)
+		p.conn.Write(pub)
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P384(), peer)
+	if x == nil {
+		p.t.Fatal("received a public key that isn't valid")
+	}
+
+	b, _ := elliptic.P384().ScalarMult(x, y, priv.D.Bytes())
+	shared := sha256.Sum256(b.Bytes())
+
+	block, _ := aes.NewCipher(shared[:])
+	p.gcm, _ = cipher.NewGCM(block)
+}
+
+func (p *v2Peer) seal(b []byte) []byte {
+	if p.gcm == nil {
+		return b
+	}
+
+	nonce := make([]byte, p.gcm.NonceSize())
+	rand.Read(nonce)
+
+	return p.gcm.Seal(nonce, nonce, b, nil)
+}
+
+func (p *v2Peer) open(b []byte) []byte {
+	if p.gcm == nil {
+		return b
+	}
+
+	n := p.gcm.NonceSize()
+	if len(b) < n {
+		p.t.Fatal("received a frame that's too short")
+	}
+
+	plain, err := p.gcm.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return plain
+}
+
+func (p *v2Peer) readN(n int) []byte {
+	b := make([]byte, n)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(p.conn, b)
+	if err != nil {
+		p.t.Error(err)
+	}
+
+	return b
+}
+
+func (p *v2Peer) write(msgType int, data []byte) {
+	frame := p.seal(append(intToBytes(msgType), data...))
+
+	w := bufio.NewWriter(p.conn)
+	w.Write(intToBytes(len(frame)))
+	w.Write(frame)
+	w.Flush()
+}
+
+// read - the next frame, including control messages which version 2 ignores
+func (p *v2Peer) read() (int, string) {
+	frame := p.open(p.readN(bytesToInt(p.readN(4))))
+	if len(frame) < 4 {
+		p.t.Fatal("received a frame that's too short")
+	}
+
+	return bytesToInt(frame), string(frame[4:])
+}
+
+// version 2 clients connect, and nothing they can't read is sent to them
+func TestHandshakeVersion2Client(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprint("encrypted=", encrypted), func(t *testing.T) {
+			name := testName()
+
+			s, err := StartServer(name, &ServerConfig{MultiClient: true, Encryption: encrypted, Heartbeat: time.Millisecond,
+				Reliable: true, ResumeTimeout: time.Second, Rekey: RekeyConfig{Messages: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			sr := messages(s.ReadContext)
+
+			p := dialV2(t, name)
+			waitFor(t, sr, isStatus(Connected))
+			ss := s.Sessions()[0]
+
+			f := ss.NegotiatedFeatures()
+			if f.Version != 2 || len(f.Names) != 0 {
+				t.Fatalf("agreed on %+v with a version 2 client", f)
+			}
+			if encrypted && (ss.Curve() != P384 || ss.CipherSuite() != AES256GCM) {
+				t.Fatalf("encrypted with %s and %s", ss.Curve(), ss.CipherSuite())
+			}
+
+			time.Sleep(20 * time.Millisecond) // time for pings, which it wouldn't answer
+
+			for i := range 3 {
+				p.write(5, fmt.Append(nil, "to server ", i))
+				if m := waitFor(t, sr, isMsg(5)); string(m.Data) != fmt.Sprint("to server ", i) {
+					t.Fatalf("server received %q", m.Data)
+				}
+
+				ss.Write(6, fmt.Append(nil, "to client ", i))
+				if msgType, data := p.read(); msgType != 6 || data != fmt.Sprint("to client ", i) {
+					t.Fatalf("client received %d %q", msgType, data)
+				}
+			}
+		})
+	}
+}
+
+// clients connect to version 2 servers
+func TestHandshakeVersion2Server(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprint("encrypted=", encrypted), func(t *testing.T) {
+			name := testName()
+			peers := listenV2(t, name, encrypted)
+
+			c, err := StartClient(name, &ClientConfig{Encryption: encrypted, Heartbeat: time.Millisecond, Reliable: true,
+				Rekey: RekeyConfig{Messages: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			cr := messages(c.ReadContext)
+
+			waitFor(t, cr, isStatus(Connected))
+			p := <-peers
+
+			f := c.NegotiatedFeatures()
+			if f.Version != 2 || len(f.Names) != 0 {
+				t.Fatalf("agreed on %+v with a version 2 server", f)
+			}
+			if encrypted && (c.Curve() != P384 || c.CipherSuite() != AES256GCM) {
+				t.Fatalf("encrypted with %s and %s", c.Curve(), c.CipherSuite())
+			}
+
+			_, err = c.Call(context.Background(), 7, nil)
+			if err == nil {
+				t.Fatal("a call was made to a version 2 server")
+			}
+
+			time.Sleep(20 * time.Millisecond)
+
+			for i := range 3 {
+				c.Write(5, fmt.Append(nil, "to server ", i))
+				if msgType, data := p.read(); msgType != 5 || data != fmt.Sprint("to server ", i) {
+					t.Fatalf("server received %d %q", msgType, data)
+				}
+
+				p.write(6, fmt.Append(nil, "to client ", i))
+				if m := waitFor(t, cr, isMsg(6)); string(m.Data) != fmt.Sprint("to client ", i) {
+					t.Fatalf("client received %q", m.Data)
+				}
+			}
+		})
+	}
+}
+
+// newer clients of a server that also takes version 2 clients replace the version 2 key with the current exchange
+func TestHandshakeVersion2Upgrade(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{Encryption: true}, &ClientConfig{Encryption: true})
+
+	if v := c.NegotiatedFeatures().Version; v != version {
+		t.Fatalf("agreed on version %d", v)
+	}
+	if c.Curve() != X25519 || s.Sessions()[0].Curve() != X25519 {
+		t.Fatalf("the key exchange used %s", c.Curve())
+	}
+
+	exchange(t, c.Write, sr, "to server")
+	exchange(t, s.Write, cr, "to client")
+}
+
+// a server that authenticates doesn't take version 2 clients, which refuse its version
+func TestHandshakeVersion2Authenticated(t *testing.T) {
+	name := testName()
+
+	s, err := StartServer(name, &ServerConfig{MultiClient: true, Encryption: true, PSK: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sr := messages(s.ReadContext)
+
+	conn, err := net.Dial("unix", socketPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &v2Peer{t: t, conn: conn}
+
+	if recv := p.readN(2); recv[0] == 2 {
+		t.Fatal("the server started the handshake as version 2")
+	}
+	conn.Write([]byte{1})
+
+	waitFor(t, sr, func(m *Message) bool { return m.Err != nil })
+}
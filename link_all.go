@@ -0,0 +1,148 @@
+package ipc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// readMsg - blocks until the next frame has been read from the connection.
+// returns nil for control messages (type 0), a message with Err set if the frame could not be decrypted
+// and an error if reading from the connection failed.
+func (l *link) readMsg() (*Message, error) {
+	bLen := make([]byte, 4)
+	files, err := readFiles(l.conn, bLen) // descriptors arrive with the first byte of the frame they were sent with
+	if err != nil {
+		return nil, err
+	}
+
+	handedOn := false
+	defer func() {
+		if !handedOn {
+			closeFiles(files)
+		}
+	}()
+
+	mLen := bytesToInt(bLen)
+	msgRecvd := make([]byte, mLen)
+	_, err = io.ReadFull(l.conn, msgRecvd)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.enc != nil {
+		var msgType []byte
+		msgType, msgRecvd, err = l.enc.open(msgRecvd, 4)
+		if err != nil {
+			var replay *ReplayError
+			if errors.As(err, &replay) {
+				// dropped, the frames after it are still accepted
+				return &Message{MsgType: -3, Event: &Event{Type: EventReplay, Err: err}}, nil
+			}
+
+			return &Message{Err: err, MsgType: -1}, nil
+		}
+
+		msgRecvd = append(msgType, msgRecvd...)
+		l.checkRekey(l.enc)
+	}
+
+	m, err := readHeader(msgRecvd)
+	if err != nil {
+		return &Message{Err: err, MsgType: -1}, nil
+	}
+
+	if m.flags&flagCompressed != 0 {
+		m.Data, err = l.comp.decompress(m.Data, l.maxSize)
+		if err != nil {
+			return &Message{Err: err, MsgType: -1}, nil
+		}
+		m.flags &^= flagCompressed
+	}
+
+	m.Files, err = l.takeFiles(m, files)
+	if err != nil {
+		return &Message{Err: err, MsgType: -1}, nil
+	}
+	files = m.Files
+
+	if m.flags&flagStream != 0 {
+		m.codec = l.codec
+		return l.streamFrame(m), nil
+	}
+
+	if m.MsgType == 0 && len(m.Data) > 0 && m.Data[0] == controlRekey {
+		// handled here rather than by handleControl as it changes the key the following frames are read with
+		e, err := l.rekey(m.Data[1:])
+		if err != nil {
+			return &Message{Err: err, MsgType: -1}, nil
+		}
+		if e != nil {
+			return &Message{MsgType: -3, Event: e}, nil
+		}
+
+		return nil, nil
+	}
+
+	if m.MsgType == 0 {
+		//  type 0 = control message
+		err = l.handleControl(m)
+		if err != nil {
+			return &Message{Err: err, MsgType: -1}, nil
+		}
+
+		return nil, nil
+	}
+
+	m.codec = l.codec
+	handedOn = true
+
+	return m, nil
+}
+
+// writeMsg - frames, encrypts (if enabled) and writes a single message to the connection
+func (l *link) writeMsg(m *Message) error {
+	// the client holds wmu while it reconnects, so the key and the connection can't change under us
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	return l.writeLocked(m)
+}
+
+// writeLocked - writeMsg for callers that already hold wmu
+func (l *link) writeLocked(m *Message) error {
+	defer closeFiles(m.Files) // copies made by WriteWithFDs, the other end has its own once they've been sent
+
+	if l.comp != 0 && len(m.Data) >= l.compMin {
+		m = l.compressed(m) // before it's encrypted, encrypted data doesn't compress
+	}
+
+	toSend := m.header()
+	toSend = append(toSend, m.Data...)
+
+	if l.enc != nil {
+		// the message type is sent in the clear so it can be authenticated along with the sequence number
+		toSend = l.enc.seal(toSend[:4], toSend[4:])
+		l.checkRekey(l.enc)
+	}
+
+	if len(m.Files) > 0 {
+		return sendFiles(l.conn, append(intToBytes(len(toSend)), toSend...), m.Files)
+	}
+
+	writer := bufio.NewWriter(l.conn)
+	writer.Write(intToBytes(len(toSend)))
+	writer.Write(toSend)
+
+	return writer.Flush()
+}
+
+// discard - closes the stream and descriptors that came with a message that isn't being handed on, so the sender of
+// the stream isn't left waiting for credit
+func (m *Message) discard() {
+	if m.Stream != nil {
+		m.Stream.Close()
+	}
+
+	closeFiles(m.Files)
+}
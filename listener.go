@@ -0,0 +1,126 @@
+package ipc
+
+import (
+	"context"
+	"net"
+)
+
+// Listener - returns a net.Listener that accepts the channels opened by clients, so net/http, gRPC and
+// anything else that serves a net.Listener can be run over the ipc connection.
+// Closing the listener stops it accepting channels but leaves the server running.
+func (s *Server) Listener() net.Listener {
+	return &listener{s: s, closed: make(chan struct{})}
+}
+
+// Accept - waits for a client to open a channel, see Server.AcceptChannel
+func (ln *listener) Accept() (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-ln.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ch, err := ln.s.AcceptChannel(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// Close - stops the listener accepting channels
+func (ln *listener) Close() error {
+	ln.once.Do(func() { close(ln.closed) })
+
+	return nil
+}
+
+// Addr - returns the name of the server's socket or pipe
+func (ln *listener) Addr() net.Addr {
+	return Addr(ln.s.Name)
+}
+
+// Dialer - returns a function that connects to the server named addr and opens a channel to it, for use with
+// grpc.WithContextDialer. See DialContext.
+func (conf ClientConfig) Dialer() func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return conf.DialContext(ctx, "ipc", addr)
+	}
+}
+
+// DialContext - connects to the server named addr and opens a channel to it, it can be used as http.Transport.DialContext.
+// Any port in addr is ignored, so the server name can be used as the host of a url.
+// Each call starts a new client using the config, closing the returned net.Conn closes the client as well.
+func (conf ClientConfig) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	life, cancel := context.WithCancel(context.Background())
+
+	c, err := StartClientContext(life, addr, &conf)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for c.Status() != Connected {
+		_, err := c.ReadContext(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	// the connection's status messages still need reading while the channel is in use
+	go func() {
+		for {
+			_, err := c.ReadContext(life)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ch, err := c.OpenChannel()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &dialedChannel{Channel: ch, cancel: cancel}, nil
+}
+
+// dialedChannel - a channel that owns the client it was opened by
+type dialedChannel struct {
+	*Channel
+	cancel context.CancelFunc
+}
+
+// Close - closes the channel and the client
+func (dc *dialedChannel) Close() error {
+	err := dc.Channel.Close()
+	dc.cancel()
+
+	return err
+}
+
+// Network - returns "ipc"
+func (a Addr) Network() string {
+	return "ipc"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+var _ net.Conn = (*Channel)(nil)
@@ -0,0 +1,372 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// outbox file - a log the outbox appends to rather than rewriting, so a message written while reconnecting costs a
+// single write. Each record is either a message added at the back or, with message type 0 which can't be written, the
+// number of messages removed from the front. Once the file holds as many removed messages as the outbox can hold it's
+// compacted, the messages left are written to a new file which is synced and renamed over the old one, so a crash
+// leaves one or the other. A record cut short by a crash is ignored when the file is loaded.
+
+// newOutbox - creates the outbox, loading any messages left in its file by an earlier client
+func newOutbox(conf OutboxConfig) (*outbox, error) {
+	if conf.Size <= 0 {
+		conf.Size = defaultOutboxSize
+	}
+
+	o := &outbox{
+		conf:    conf,
+		changed: make(chan struct{}),
+	}
+
+	if conf.Path == "" {
+		return o, nil
+	}
+
+	f, err := os.Open(conf.Path)
+	if err == nil {
+		o.msgs, err = readOutbox(f)
+		f.Close()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(o.msgs) > conf.Size {
+		o.msgs = o.msgs[len(o.msgs)-conf.Size:]
+	}
+	o.dropExpired()
+
+	return o, o.compact()
+}
+
+// queueing - whether a message written now has to go in the outbox, either because the client is reconnecting
+// or because the outbox hasn't been emptied since it reconnected and the message has to wait its turn
+func (c *Client) queueing() bool {
+	if c.outbox == nil || c.draining.Load() {
+		return false
+	}
+
+	return c.status.get() == ReConnecting || (c.status.get() == Connected && c.outbox.len() > 0)
+}
+
+// flushOutbox - sends the messages in the outbox in order, stops if the connection is lost again
+func (c *Client) flushOutbox() {
+	if c.outbox == nil {
+		return
+	}
+
+	c.outbox.flushMu.Lock()
+	defer c.outbox.flushMu.Unlock()
+	defer c.outbox.save()
+
+	for c.status.get() == Connected {
+		m, ok := c.outbox.peek()
+		if !ok {
+			return
+		}
+
+		select {
+		case c.sent <- &Message{MsgType: m.msgType, Data: m.data}:
+		case <-c.done:
+			return
+		}
+
+		// only removed once it's been sent, so Write keeps queueing behind it until then
+		c.outbox.pop()
+	}
+}
+
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.msgs)
+}
+
+// push - adds a message to the outbox, applying the overflow policy if it's full
+func (o *outbox) push(ctx context.Context, msgType int, data []byte, done chan struct{}) error {
+	m := outboxMsg{msgType: msgType, data: data}
+	if o.conf.TTL > 0 {
+		m.expires = time.Now().Add(o.conf.TTL)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for {
+		o.dropExpired()
+
+		if len(o.msgs) < o.conf.Size {
+			break
+		}
+
+		switch o.conf.Overflow {
+		case OutboxDropNewest:
+			return errors.New("outbox is full, the message has been dropped")
+
+		case OutboxBlock:
+			changed := o.changed
+			o.mu.Unlock()
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				o.mu.Lock()
+				return ctx.Err()
+			case <-done:
+				o.mu.Lock()
+				return errors.New("the client has been closed")
+			}
+
+			o.mu.Lock()
+			continue
+
+		default:
+			o.remove(1)
+		}
+	}
+
+	o.msgs = append(o.msgs, m)
+
+	return o.log(m)
+}
+
+// peek - returns the oldest message that hasn't expired
+func (o *outbox) peek() (outboxMsg, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.dropExpired()
+
+	if len(o.msgs) == 0 {
+		return outboxMsg{}, false
+	}
+
+	return o.msgs[0], true
+}
+
+// pop - removes the oldest message once it's been sent, the file is brought up to date when the flush finishes
+func (o *outbox) pop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.msgs) > 0 {
+		o.remove(1)
+	}
+}
+
+// dropExpired - removes the messages at the front of the outbox whose ttl has passed, must be called with mu held
+func (o *outbox) dropExpired() {
+	now := time.Now()
+
+	n := 0
+	for n < len(o.msgs) && !o.msgs[n].expires.IsZero() && now.After(o.msgs[n].expires) {
+		n++
+	}
+
+	if n > 0 {
+		o.remove(n)
+	}
+}
+
+// remove - drops the n oldest messages, must be called with mu held
+func (o *outbox) remove(n int) {
+	clear(o.msgs[:n])
+	o.msgs = o.msgs[n:]
+	o.signal()
+
+	if o.file != nil {
+		o.removed += n
+	}
+}
+
+// signal - wakes any writes waiting for room, must be called with mu held
+func (o *outbox) signal() {
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// save - logs the messages removed since it was last saved and makes sure the file is on disk
+func (o *outbox) save() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.sync()
+}
+
+// close - saves the outbox and closes its file, the messages left in it are sent by the next client to use the file
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.file != nil {
+		o.sync()
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+// log - appends a message that has just been added to the file, must be called with mu held
+func (o *outbox) log(m outboxMsg) error {
+	if o.file == nil {
+		return nil
+	}
+
+	if o.logged+1-len(o.msgs) >= o.conf.Size {
+		return o.compact()
+	}
+
+	_, err := o.file.Write(append(o.removals(), encodeOutboxMsg(m)...))
+	o.logged++
+
+	return err
+}
+
+// sync - does the work of save, must be called with mu held
+func (o *outbox) sync() error {
+	if o.file == nil {
+		return nil
+	}
+
+	if o.logged-len(o.msgs) >= o.conf.Size {
+		return o.compact()
+	}
+
+	if b := o.removals(); b != nil {
+		_, err := o.file.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.file.Sync()
+}
+
+// removals - the record of the messages removed that haven't been logged yet, nil if there aren't any
+func (o *outbox) removals() []byte {
+	if o.removed == 0 {
+		return nil
+	}
+
+	b := encodeOutboxMsg(outboxMsg{data: intToBytes(o.removed)})
+	o.removed = 0
+
+	return b
+}
+
+// compact - replaces the file with one that only holds the messages left, must be called with mu held
+func (o *outbox) compact() error {
+	tmp := o.conf.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, m := range o.msgs {
+		w.Write(encodeOutboxMsg(m))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close() // windows can't rename over a file that's open
+		o.file = nil
+	}
+
+	err = os.Rename(tmp, o.conf.Path)
+	if err != nil {
+		return err
+	}
+
+	o.file, err = os.OpenFile(o.conf.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	o.logged, o.removed = len(o.msgs), 0
+
+	return nil
+}
+
+// each record in the outbox file is
+// byte 0-7  = expiry time in unix nanoseconds, 0 if it doesn't expire
+// byte 8-11 = message type, 0 if the data is the number of messages removed from the front
+// byte 12-15 = length of the data, followed by the data
+func encodeOutboxMsg(m outboxMsg) []byte {
+	b := make([]byte, 16, 16+len(m.data))
+
+	if !m.expires.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(m.expires.UnixNano()))
+	}
+	binary.BigEndian.PutUint32(b[8:], uint32(m.msgType))
+	binary.BigEndian.PutUint32(b[12:], uint32(len(m.data)))
+
+	return append(b, m.data...)
+}
+
+func readOutbox(r io.Reader) ([]outboxMsg, error) {
+	var msgs []outboxMsg
+
+	br := bufio.NewReader(r)
+	header := make([]byte, 16)
+
+	for {
+		_, err := io.ReadFull(br, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return msgs, nil // a record cut short was still being written
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m := outboxMsg{
+			msgType: int(binary.BigEndian.Uint32(header[8:])),
+			data:    make([]byte, binary.BigEndian.Uint32(header[12:])),
+		}
+		if expires := binary.BigEndian.Uint64(header); expires != 0 {
+			m.expires = time.Unix(0, int64(expires))
+		}
+
+		_, err = io.ReadFull(br, m.data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if m.msgType != 0 {
+			msgs = append(msgs, m)
+			continue
+		}
+
+		n := 0
+		if len(m.data) == 4 {
+			n = bytesToInt(m.data)
+		}
+		if n <= 0 || n > len(msgs) {
+			return nil, errors.New("outbox file is corrupt")
+		}
+		clear(msgs[:n])
+		msgs = msgs[n:]
+	}
+}
@@ -0,0 +1,186 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// drain - the data of the messages left in the outbox, oldest first
+func drain(o *outbox) []string {
+	var data []string
+	for {
+		m, ok := o.peek()
+		if !ok {
+			return data
+		}
+
+		data = append(data, string(m.data))
+		o.pop()
+	}
+}
+
+func expectMsgs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("outbox held %q, expected %q", got, want)
+	}
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	push := func(o *outbox, data string) error {
+		return o.push(context.Background(), 5, []byte(data), nil)
+	}
+
+	t.Run("DropOldest", func(t *testing.T) {
+		o, _ := newOutbox(OutboxConfig{Size: 3, Overflow: OutboxDropOldest})
+		for i := range 5 {
+			if err := push(o, fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expectMsgs(t, drain(o), "2", "3", "4")
+	})
+
+	t.Run("DropNewest", func(t *testing.T) {
+		o, _ := newOutbox(OutboxConfig{Size: 3, Overflow: OutboxDropNewest})
+		for i := range 3 {
+			push(o, fmt.Sprint(i))
+		}
+
+		if err := push(o, "3"); err == nil {
+			t.Fatal("a message was added to a full outbox")
+		}
+
+		expectMsgs(t, drain(o), "0", "1", "2")
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		o, _ := newOutbox(OutboxConfig{Size: 3, Overflow: OutboxBlock})
+		for i := range 3 {
+			push(o, fmt.Sprint(i))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := o.push(ctx, 5, []byte("3"), nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("a write to a full outbox returned %v", err)
+		}
+
+		pushed := make(chan error)
+		go func() { pushed <- push(o, "3") }()
+
+		select {
+		case <-pushed:
+			t.Fatal("a write to a full outbox didn't wait")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		o.pop()
+		if err := <-pushed; err != nil {
+			t.Fatal(err)
+		}
+
+		expectMsgs(t, drain(o), "1", "2", "3")
+	})
+}
+
+func TestOutboxTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	o, err := newOutbox(OutboxConfig{TTL: 20 * time.Millisecond, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.push(context.Background(), 5, []byte("expires"), nil)
+	time.Sleep(40 * time.Millisecond)
+	o.push(context.Background(), 5, []byte("kept"), nil)
+	o.close()
+
+	o, err = newOutbox(OutboxConfig{TTL: 20 * time.Millisecond, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	expectMsgs(t, drain(o), "kept")
+}
+
+// the messages left in the file are loaded by the next outbox to use it, and the file doesn't grow without limit
+func TestOutboxReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	conf := OutboxConfig{Size: 10, Path: path}
+
+	o, err := newOutbox(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := range 1000 {
+		data := fmt.Sprintf("%04d", i)
+		o.push(context.Background(), 5, []byte(data), nil)
+		if len(want) == conf.Size {
+			want = want[1:]
+		}
+		want = append(want, data)
+
+		if i%3 == 0 {
+			o.pop()
+			want = want[1:]
+		}
+	}
+	o.close()
+
+	if info, _ := os.Stat(path); info.Size() > int64(4*conf.Size*(16+4)) {
+		t.Fatalf("the file has grown to %d bytes", info.Size())
+	}
+
+	// a record cut short as if the client had crashed while writing it
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write(encodeOutboxMsg(outboxMsg{msgType: 5, data: []byte("torn")})[:18])
+	f.Close()
+
+	o, err = newOutbox(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+
+	expectMsgs(t, drain(o), want...)
+}
+
+// messages written while the client is reconnecting are sent in order once it has reconnected
+func TestOutboxReconnect(t *testing.T) {
+	s, _, c, cr := start(t, &ServerConfig{}, &ClientConfig{Outbox: &OutboxConfig{}})
+
+	s.Close()
+	waitFor(t, cr, isStatus(ReConnecting))
+
+	for i := range 3 {
+		err := c.Write(5, fmt.Append(nil, "queued ", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := StartServer(c.Name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sr := messages(s.ReadContext)
+
+	for i := range 3 {
+		m := waitFor(t, sr, isMsg(5))
+		if string(m.Data) != fmt.Sprint("queued ", i) {
+			t.Fatalf("received %q", m.Data)
+		}
+	}
+}
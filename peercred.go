@@ -0,0 +1,45 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// authorize - checks the client is allowed to connect before the handshake is started, returns its credentials.
+// Clients are refused if their credentials can't be read and the server has been configured to check them.
+func (s *Server) authorize(conn net.Conn) (*PeerCred, error) {
+	checking := s.conf.Authorize != nil || len(s.conf.AllowUIDs) > 0 || len(s.conf.AllowGIDs) > 0
+
+	cred, err := peerCred(conn)
+	if err != nil {
+		if checking {
+			return nil, &AuthError{Reason: "unable to read the credentials of the client", Err: err}
+		}
+
+		return nil, nil
+	}
+
+	if len(s.conf.AllowUIDs) > 0 && !slices.Contains(s.conf.AllowUIDs, cred.UID) {
+		return nil, &AuthError{Reason: fmt.Sprintf("client pid %d refused, uid %d is not allowed", cred.PID, cred.UID)}
+	}
+
+	// only the primary group is known from the socket
+	if len(s.conf.AllowGIDs) > 0 && !slices.Contains(s.conf.AllowGIDs, cred.GID) {
+		return nil, &AuthError{Reason: fmt.Sprintf("client pid %d refused, gid %d is not allowed", cred.PID, cred.GID)}
+	}
+
+	if s.conf.Authorize != nil {
+		err = s.conf.Authorize(cred)
+		if err != nil {
+			return nil, &AuthError{Reason: fmt.Sprintf("client pid %d refused", cred.PID), Err: err}
+		}
+	}
+
+	return cred, nil
+}
+
+// PeerCred - returns the credentials of the client process, or nil if they aren't available on this platform
+func (ss *Session) PeerCred() *PeerCred {
+	return ss.peer
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred - peer credentials are only read on linux
+func peerCred(conn net.Conn) (*PeerCred, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package ipc
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// refused - starts a server and a client it should refuse, returns the error the server reports
+func refused(t *testing.T, conf *ServerConfig) *AuthError {
+	t.Helper()
+
+	name := testName()
+
+	s, err := StartServer(name, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sr := messages(s.ReadContext)
+
+	c, err := StartClient(name, &ClientConfig{DisableReconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	messages(c.ReadContext)
+
+	m := waitFor(t, sr, func(m *Message) bool { return m.Err != nil || isStatus(Connected)(m) })
+	if m.Err == nil {
+		t.Fatal("the client was accepted")
+	}
+
+	var aerr *AuthError
+	if !errors.As(m.Err, &aerr) {
+		t.Fatalf("the client was refused with %v", m.Err)
+	}
+	if len(s.Sessions()) != 0 {
+		t.Fatal("a session was started for the client")
+	}
+
+	return aerr
+}
+
+func TestPeerCred(t *testing.T) {
+	var authorized *PeerCred
+	s, sr, c, _ := start(t, &ServerConfig{
+		MultiClient: true,
+		AllowUIDs:   []int{os.Getuid() + 1, os.Getuid()},
+		AllowGIDs:   []int{os.Getgid()},
+		Authorize: func(cred *PeerCred) error {
+			authorized = cred
+			return nil
+		},
+	}, &ClientConfig{})
+
+	want := PeerCred{PID: os.Getpid(), UID: os.Getuid(), GID: os.Getgid()}
+	if authorized == nil || *authorized != want {
+		t.Fatalf("Authorize was called with %v, expected %v", authorized, want)
+	}
+	if cred := s.Sessions()[0].PeerCred(); cred == nil || *cred != want {
+		t.Fatalf("the session has the credentials %v, expected %v", cred, want)
+	}
+
+	c.Write(5, nil)
+	if cred := waitFor(t, sr, isMsg(5)).PeerCred; cred == nil || *cred != want {
+		t.Fatalf("the message has the credentials %v, expected %v", cred, want)
+	}
+}
+
+func TestPeerCredRefused(t *testing.T) {
+	t.Run("uid", func(t *testing.T) {
+		refused(t, &ServerConfig{AllowUIDs: []int{os.Getuid() + 1}})
+	})
+
+	t.Run("gid", func(t *testing.T) {
+		refused(t, &ServerConfig{AllowGIDs: []int{os.Getgid() + 1}})
+	})
+
+	t.Run("Authorize", func(t *testing.T) {
+		untrusted := errors.New("untrusted process")
+		err := refused(t, &ServerConfig{Authorize: func(cred *PeerCred) error { return untrusted }})
+		if !errors.Is(err, untrusted) {
+			t.Fatalf("refused with %v", err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package ipc
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+var errGaveUp = errors.New("gave up trying to connect")
+
+// errBadFrame - the server sent a frame that couldn't be used, the client reconnects
+var errBadFrame = errors.New("received a frame that couldn't be used")
+
+// Next - waits Delay before every attempt
+func (p ConstantBackoff) Next(attempt int) (time.Duration, bool) {
+	return p.Delay, true
+}
+
+// Next - waits Initial before the 2nd attempt and Multiplier times longer before each one after it, up to Max
+func (p ExponentialBackoff) Next(attempt int) (time.Duration, bool) {
+	initial, limit, multiplier := p.Initial, p.Max, p.Multiplier
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	if limit <= 0 {
+		limit = defaultBackoffMax
+	}
+	if multiplier < 1 {
+		multiplier = defaultBackoffMultiplier
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if d > float64(limit) {
+		d = float64(limit)
+	}
+
+	jitter := min(max(p.Jitter, 0), 1)
+	d -= d * jitter * rand.Float64()
+
+	return time.Duration(d), true
+}
+
+// Next - gives up once Attempts attempts have failed, otherwise waits as long as Policy says
+func (p MaxAttempts) Next(attempt int) (time.Duration, bool) {
+	if attempt >= p.Attempts {
+		return 0, false
+	}
+
+	if p.Policy == nil {
+		return defaultRetryTimer, true // the client uses its RetryTimer instead
+	}
+
+	return p.Policy.Next(attempt)
+}
+
+// retry - called after an attempt to connect has failed, waits as long as the reconnect policy says before the next one.
+// returns an error if the client should stop trying.
+func (c *Client) retry(attempt int, err error) error {
+	policy := c.conf.Reconnect
+	if policy == nil {
+		policy = ConstantBackoff{Delay: c.conf.RetryTimer}
+	}
+
+	if p, ok := policy.(MaxAttempts); ok && p.Policy == nil {
+		p.Policy = ConstantBackoff{Delay: c.conf.RetryTimer}
+		policy = p
+	}
+
+	delay, ok := policy.Next(attempt)
+	if !ok {
+		c.notify(&Message{MsgType: -3, Status: c.status.String(), Event: &Event{Type: EventGaveUp, Attempt: attempt, Err: err}})
+
+		return errGaveUp
+	}
+
+	c.notify(&Message{MsgType: -3, Status: c.status.String(), Event: &Event{Type: EventRetry, Attempt: attempt, Delay: delay, Err: err}})
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-c.ctx.Done():
+		c.status.set(Closed)
+		return c.ctx.Err()
+	case <-c.done:
+		return errors.New("client has closed the connection")
+	}
+}
+
+// giveUp - closes the client once the reconnect policy has stopped it trying to connect
+func (c *Client) giveUp() {
+	c.Close()
+	c.status.set(Closed)
+}
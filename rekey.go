@@ -0,0 +1,194 @@
+package ipc
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"time"
+)
+
+// rekeying - once the key of an encrypted connection reaches one of the limits in RekeyConfig, the end that noticed
+// makes a new key exchange with the other one over the connection (so it's encrypted and authenticated by the old key).
+// Each direction switches to the new key at a known frame so nothing in flight is read with the wrong key:
+//
+// A: request + A's public key
+// B: response + B's public key, B sends with the new key from the next frame
+// A: switch, A reads with the new key after the response and sends with it from the next frame
+// B: reads with the new key after the switch
+//
+// If both ends ask at once the server's request is answered and the client's is dropped.
+const (
+	rekeyRequest byte = iota + 1
+	rekeyResponse
+	rekeySwitch
+)
+
+// checkRekey - asks the other end for a new key once the current one has reached one of the limits, called after
+// each frame is sent or received
+func (l *link) checkRekey(e *encryption) {
+	if e.legacy || !l.rekeyAt.reached(e) {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.rekeying {
+		return
+	}
+
+	priv, err := generateKey(e.rekeyCurve())
+	if err != nil {
+		return
+	}
+
+	e.rekeying, e.priv = true, priv
+
+	// the caller may be holding wmu
+	go l.requestRekey(e, priv)
+}
+
+// requestRekey - sends the request for a rekey unless the client has dropped it to answer the server's
+func (l *link) requestRekey(e *encryption, priv *ecdh.PrivateKey) {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	e.mu.Lock()
+	asked := e.priv == priv
+	e.mu.Unlock()
+
+	if asked && l.enc == e {
+		l.writeLocked(&Message{MsgType: 0, Data: append([]byte{controlRekey, rekeyRequest}, priv.PublicKey().Bytes()...)})
+	}
+}
+
+// rekey - handles a rekey message from the other end, returns the event to pass on once this end has switched
+func (l *link) rekey(data []byte) (*Event, error) {
+	e := l.enc
+	if e == nil || len(data) == 0 {
+		return nil, errors.New("received a rekey message on a connection that isn't encrypted")
+	}
+
+	switch step, data := data[0], data[1:]; step {
+	case rekeyRequest:
+		e.mu.Lock()
+		if e.rekeying && (e.priv == nil || e.dir == dirServer) {
+			e.mu.Unlock()
+			return nil, nil // already answering one, or the server is waiting for the client to answer its own
+		}
+		e.rekeying, e.priv = true, nil
+		e.mu.Unlock()
+
+		priv, err := generateKey(e.rekeyCurve())
+		if err != nil {
+			return nil, err
+		}
+
+		pub := priv.PublicKey().Bytes()
+		next, err := e.nextKey(priv, data, transcriptHash(data, pub))
+		if err != nil {
+			return nil, err
+		}
+
+		e.next = next
+
+		return nil, l.sendRekey(e, rekeyResponse, pub, next)
+
+	case rekeyResponse:
+		e.mu.Lock()
+		priv := e.priv
+		e.mu.Unlock()
+
+		if priv == nil {
+			return nil, errors.New("received a rekey response that wasn't asked for")
+		}
+
+		next, err := e.nextKey(priv, data, transcriptHash(priv.PublicKey().Bytes(), data))
+		if err != nil {
+			return nil, err
+		}
+
+		e.opener = next
+		err = l.sendRekey(e, rekeySwitch, nil, next)
+		e.rekeyed()
+
+		return &Event{Type: EventRekey}, err
+
+	case rekeySwitch:
+		if e.next == nil {
+			return nil, errors.New("received a rekey switch that wasn't expected")
+		}
+
+		e.opener, e.next = e.next, nil
+		e.rekeyed()
+
+		return &Event{Type: EventRekey}, nil
+	}
+
+	return nil, nil // sent by a newer version, ignored
+}
+
+// sendRekey - sends a rekey message with the current key then sends with next from the following frame,
+// nothing is sent if the connection has been replaced since
+func (l *link) sendRekey(e *encryption, step byte, data []byte, next cipher.AEAD) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	if l.enc != e {
+		return nil
+	}
+
+	err := l.writeLocked(&Message{MsgType: 0, Data: append([]byte{controlRekey, step}, data...)})
+	e.sealer = next
+
+	return err
+}
+
+// nextKey - derives the new key from the shared secret of the rekey, transcript is the hash of both public keys
+func (e *encryption) nextKey(priv *ecdh.PrivateKey, peerPub, transcript []byte) (cipher.AEAD, error) {
+	secret, err := sharedSecret(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, secret, nil, "golang-ipc rekey "+string(transcript), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := e.suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return *aead, nil
+}
+
+// rekeyed - starts counting towards the limits again once both directions use the new key
+func (e *encryption) rekeyed() {
+	e.frames.Store(0)
+	e.bytes.Store(0)
+	e.keyed.Store(time.Now().UnixNano())
+
+	e.mu.Lock()
+	e.rekeying, e.priv = false, nil
+	e.mu.Unlock()
+}
+
+// rekeyCurve - the curve of the connection's key exchange, resumed connections from older tickets may not know it
+func (e *encryption) rekeyCurve() Curve {
+	if e.curve == 0 {
+		return X25519
+	}
+
+	return e.curve
+}
+
+// reached - whether the key has reached one of the limits
+func (conf RekeyConfig) reached(e *encryption) bool {
+	return conf.Messages > 0 && e.frames.Load() >= int64(conf.Messages) ||
+		conf.Bytes > 0 && e.bytes.Load() >= int64(conf.Bytes) ||
+		conf.Interval > 0 && time.Since(time.Unix(0, e.keyed.Load())) >= conf.Interval
+}
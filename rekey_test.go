@@ -0,0 +1,71 @@
+package ipc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// both ends write as fast as they can while the key is replaced, every message arrives once and in order
+func TestRekeyUnderLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		server RekeyConfig
+		client RekeyConfig
+	}{
+		{"server", RekeyConfig{Messages: 50}, RekeyConfig{}},
+		{"client", RekeyConfig{}, RekeyConfig{Messages: 50}},
+		{"both", RekeyConfig{Messages: 30}, RekeyConfig{Bytes: 4096}},
+		{"interval", RekeyConfig{}, RekeyConfig{Interval: 5 * time.Millisecond}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{Encryption: true, Rekey: tc.server}, &ClientConfig{Encryption: true, Rekey: tc.client})
+			ss := s.Sessions()[0]
+
+			const n = 2000
+			errs := make(chan error, 2)
+			for _, write := range []func(int, []byte) error{c.Write, ss.Write} {
+				go func() {
+					for i := range n {
+						err := write(5, fmt.Append(nil, i))
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+					errs <- nil
+				}()
+			}
+
+			rekeys := 0
+			for _, received := range []chan *Message{sr, cr} {
+				for i := range n {
+					m := waitFor(t, received, func(m *Message) bool {
+						if m.Event != nil && m.Event.Type == EventRekey {
+							rekeys++
+						}
+						if m.Err != nil {
+							t.Fatal(m.Err)
+						}
+
+						return m.MsgType == 5
+					})
+
+					if string(m.Data) != fmt.Sprint(i) {
+						t.Fatalf("received message %s, expected %d", m.Data, i)
+					}
+				}
+			}
+
+			for range 2 {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if rekeys == 0 {
+				t.Fatal("the key wasn't replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// reliable delivery - each message written with Write (or Send, Broadcast etc) is given a sequence number and kept until
+// the other end acknowledges it. At the start of every connection both ends send the sequence number of the last message
+// they received, and anything after it is sent again before any new messages, so messages lost with a connection are
+// delivered once the client reconnects. Messages that arrive twice are dropped by the receiver.
+// Calls, streams and channels aren't covered, they fail when the connection is lost.
+//
+// Each end's state has a random epoch that's sent along with where to resume from. If the other end's epoch has
+// changed (it has restarted, or a MultiClient session wasn't resumed) its numbering starts again, and if it doesn't
+// know this end's epoch the messages it hasn't acknowledged are numbered again from 1 before they're sent.
+
+func newReliable() *reliable {
+	return &reliable{
+		epoch: rand.Uint64(),
+		ready: make(chan struct{}),
+		space: make(chan struct{}),
+	}
+}
+
+// startReliable - called once the handshake has agreed on reliable delivery, tells the other end where to resume from
+func (l *link) startReliable(r *reliable) error {
+	l.rel = r
+	r.pause()
+
+	r.mu.Lock()
+	data := binary.BigEndian.AppendUint32([]byte{controlResume}, r.received)
+	data = binary.BigEndian.AppendUint64(data, r.epoch)
+	data = binary.BigEndian.AppendUint64(data, r.peer)
+	r.mu.Unlock()
+
+	return l.writeMsg(&Message{MsgType: 0, Data: data})
+}
+
+// pause - holds back new messages until the other end says where to resume from
+func (r *reliable) pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resumed {
+		r.ready = make(chan struct{})
+		r.resumed = false
+	}
+}
+
+// restart - called with the epochs sent with the other end's resume, before any of the messages that follow it are read.
+// returns false if the other end doesn't know this end's epoch, in which case its sequence number doesn't apply.
+func (r *reliable) restart(epoch, known uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if epoch != r.peer {
+		r.peer = epoch
+		r.received = 0
+	}
+
+	if known == r.epoch {
+		return true
+	}
+
+	// copies, the old ones could still be being written to the last connection
+	for i, m := range r.unacked {
+		c := *m
+		c.seq = uint32(i + 1)
+		r.unacked[i] = &c
+	}
+	r.sent = uint32(len(r.unacked))
+
+	return false
+}
+
+// resume - the other end has received everything up to seq, the messages after it are sent again then new messages can follow
+func (l *link) resume(seq uint32, known bool) {
+	r := l.rel
+
+	if known {
+		r.ack(seq)
+	}
+
+	r.mu.Lock()
+	resend := append([]*Message(nil), r.unacked...)
+	r.mu.Unlock()
+
+	for _, m := range resend {
+		err := l.writeMsg(m)
+		if err != nil {
+			log.Println("error resending data", err)
+
+			return // the connection has gone, the next one resumes from here
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.resumed {
+		close(r.ready)
+		r.resumed = true
+	}
+}
+
+// sequence - numbers a message that is about to be sent and keeps it until it's acknowledged,
+// waits for the other end to say where to resume from and for room in the window first.
+// returns false if the connection is closed while waiting.
+func (l *link) sequence(m *Message) bool {
+	r := l.rel
+	if r == nil || !isReliable(m) {
+		return true
+	}
+
+	for {
+		r.mu.Lock()
+		wait := r.ready
+		if r.resumed {
+			if len(r.unacked) < reliableWindow {
+				r.add(m)
+				r.mu.Unlock()
+
+				return true
+			}
+
+			wait = r.space
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-l.done:
+			return false
+		}
+	}
+}
+
+// keepUnsent - numbers the messages left in the send queue of a session that has been disconnected,
+// so they're sent once the client resumes on a new session. m is the message the writer was holding, if any.
+func (ss *Session) keepUnsent(m *Message) {
+	r := ss.rel
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if m != nil && isReliable(m) {
+			r.add(m)
+		}
+
+		select {
+		case m = <-ss.sent:
+		default:
+			return
+		}
+	}
+}
+
+// isReliable - whether the message is one that's delivered reliably, plain messages written by the application
+func isReliable(m *Message) bool {
+	return m.MsgType > 0 && m.flags == 0
+}
+
+// add - gives the message the next sequence number and keeps it until it's acknowledged, must be called with mu held
+func (r *reliable) add(m *Message) {
+	r.sent++
+	m.seq = r.sent
+	m.flags |= flagSeq
+	r.unacked = append(r.unacked, m)
+}
+
+// ack - drops the messages the other end has received
+func (r *reliable) ack(seq uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(r.unacked) && r.unacked[n].seq <= seq {
+		r.unacked[n] = nil
+		n++
+	}
+
+	if n > 0 {
+		r.unacked = r.unacked[n:]
+		close(r.space)
+		r.space = make(chan struct{})
+	}
+}
+
+// inOrder - checks the sequence number of a received message, returns false if it has already been received
+// or if earlier messages are missing, in which case it's sent again when the connection is resumed
+func (l *link) inOrder(m *Message) bool {
+	r := l.rel
+	if r == nil || m.flags&flagSeq == 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := m.seq == r.received+1
+	if next {
+		r.received = m.seq
+	}
+
+	if r.ackTimer == nil {
+		r.ackTimer = time.AfterFunc(ackDelay, func() { l.sendAck(r) })
+	}
+
+	return next
+}
+
+// sendAck - acknowledges every message received so far, written straight to the connection so it can't be held up
+// behind messages waiting for acks from the other end
+func (l *link) sendAck(r *reliable) {
+	r.mu.Lock()
+	r.ackTimer = nil
+	received := r.received
+	r.mu.Unlock()
+
+	l.writeMsg(&Message{MsgType: 0, Data: binary.BigEndian.AppendUint32([]byte{controlAck}, received)})
+}
@@ -0,0 +1,153 @@
+package ipc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// exchange - writes a message each way and checks both arrive
+func exchange(t *testing.T, write func(int, []byte) error, received chan *Message, data string) {
+	t.Helper()
+
+	err := write(5, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := waitFor(t, received, isMsg(5))
+	if string(m.Data) != data {
+		t.Fatalf("received %q, expected %q", m.Data, data)
+	}
+}
+
+// receiveUntil - the data of the messages read from received before the one holding last
+func receiveUntil(t *testing.T, received chan *Message, last string) []string {
+	t.Helper()
+
+	var data []string
+	for {
+		m := waitFor(t, received, isMsg(5))
+		if string(m.Data) == last {
+			return data
+		}
+
+		data = append(data, string(m.Data))
+	}
+}
+
+// retry - writes the message once the connection is back, writes fail while it's being restored
+func retry(t *testing.T, write func(int, []byte) error, data string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for write(5, []byte(data)) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection wasn't restored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// unacked - the number of messages sent that the other end hasn't acknowledged
+func unacked(l *link) int {
+	l.rel.mu.Lock()
+	defer l.rel.mu.Unlock()
+
+	return len(l.rel.unacked)
+}
+
+// the connection is lost while messages are still waiting to be acknowledged in both directions, each one is
+// delivered once and in order after the client reconnects
+func TestReliableReconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf ServerConfig
+	}{
+		{"single", ServerConfig{Reliable: true}},
+		{"resumed", ServerConfig{MultiClient: true, Reliable: true, ResumeTimeout: time.Second}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sr, c, cr := start(t, &tc.conf, &ClientConfig{Reliable: true})
+			ss := s.Sessions()[0]
+			if tc.conf.ResumeTimeout > 0 {
+				waitForTicket(t, c)
+			}
+
+			const n = 200
+			var want []string
+			for i := range n {
+				want = append(want, fmt.Sprint(i))
+				c.Write(5, fmt.Append(nil, i))
+				ss.Write(5, fmt.Append(nil, i))
+			}
+
+			if unacked(&c.link) == 0 || unacked(&ss.link) == 0 {
+				t.Fatal("every message had been acknowledged before the connection was lost")
+			}
+			ss.conn.Close()
+
+			retry(t, c.Write, "after")
+			if tc.conf.MultiClient {
+				retry(t, func(msgType int, data []byte) error { return s.WriteTo(ss.ID, msgType, data) }, "after")
+			} else {
+				retry(t, s.Write, "after")
+			}
+
+			// everything read before the marker, which was written once the connection had been lost
+			for _, got := range [][]string{receiveUntil(t, sr, "after"), receiveUntil(t, cr, "after")} {
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("received %v", got)
+				}
+			}
+		})
+	}
+}
+
+// a MultiClient server that doesn't resume sessions starts a new one, the numbering starts again in both directions
+func TestReliableNewSession(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{MultiClient: true, Reliable: true}, &ClientConfig{Reliable: true})
+
+	for i := range 3 {
+		exchange(t, c.Write, sr, fmt.Sprint("to server ", i))
+		exchange(t, s.Sessions()[0].Write, cr, fmt.Sprint("to client ", i))
+	}
+	time.Sleep(5 * ackDelay) // a new session would be sent anything the old one hadn't acknowledged
+
+	s.Sessions()[0].conn.Close()
+	waitFor(t, cr, isStatus(Connected))
+	waitFor(t, sr, isStatus(Connected))
+
+	for i := range 3 {
+		exchange(t, c.Write, sr, fmt.Sprint("to server after ", i))
+		exchange(t, s.Sessions()[0].Write, cr, fmt.Sprint("to client after ", i))
+	}
+}
+
+func TestReliableServerRestart(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{Reliable: true}, &ClientConfig{Reliable: true})
+
+	for i := range 3 {
+		exchange(t, c.Write, sr, fmt.Sprint("to server ", i))
+		exchange(t, s.Write, cr, fmt.Sprint("to client ", i))
+	}
+	time.Sleep(5 * ackDelay) // anything the old server hadn't acknowledged would be sent again to the new one
+
+	s.Close()
+	waitFor(t, cr, isStatus(ReConnecting))
+
+	s, err := StartServer(c.Name, &ServerConfig{Reliable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sr = messages(s.ReadContext)
+
+	waitFor(t, cr, isStatus(Connected))
+	waitFor(t, sr, isStatus(Connected))
+
+	for i := range 3 {
+		exchange(t, c.Write, sr, fmt.Sprint("to restarted server ", i))
+		exchange(t, s.Write, cr, fmt.Sprint("to client ", i))
+	}
+}
@@ -0,0 +1,337 @@
+package ipc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// session resumption - after each handshake the server gives the client a ticket, which is the session id and a secret
+// encrypted with a key only the server knows. When the client reconnects it presents the ticket instead of replying 0
+// to the 1st handshake message, and if the server still remembers the session the rest of the handshake is skipped.
+// The new connection keeps the session id, the features agreed on and the reliable delivery state, and its key is made
+// from the secret and a random value from each end rather than a new key exchange.
+//
+// The ticket itself is sent in the clear, so before the server touches the session the client proves it also has the
+// secret with a confirmation sealed with the new key. Each ticket can only be used once.
+
+const resumeRandomSize = 32
+
+// startTickets - creates the key the server encrypts tickets with, tickets are only issued if ResumeTimeout is set
+func (s *Server) startTickets() error {
+	if s.conf.ResumeTimeout <= 0 {
+		return nil
+	}
+
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	s.tickets, err = cipher.NewGCM(b)
+	if err != nil {
+		return err
+	}
+
+	s.resume = make(map[int]*resumption)
+
+	return nil
+}
+
+// issueTicket - gives the client a new ticket for its session, any earlier ticket stops working
+//
+// byte 0-3 = session id
+// byte 4-  = secret
+func (ss *Session) issueTicket() error {
+	s := ss.server
+	if s.tickets == nil || ss.proto == legacyVersion {
+		return nil // version 2 clients can't resume
+	}
+
+	secret := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, secret)
+	if err != nil {
+		return err
+	}
+
+	ticket, err := encrypt(s.tickets, append(intToBytes(ss.ID), secret...))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	r := s.resume[ss.ID]
+	if r == nil {
+		r = &resumption{id: ss.ID}
+		s.resume[ss.ID] = r
+	}
+	r.secret = secret
+	r.features, r.proto, r.comp = ss.features, ss.proto, ss.comp
+	r.peerKey = ss.peerKey
+	if ss.enc != nil {
+		r.curve, r.suite = ss.enc.curve, ss.enc.suite
+	}
+	r.rel = ss.rel
+	r.owner = ss
+	s.mu.Unlock()
+
+	data := binary.BigEndian.AppendUint16(nil, uint16(len(ticket)))
+	data = append(data, ticket...)
+	data = append(data, secret...)
+
+	return ss.sendControl(controlTicket, data)
+}
+
+// acceptTicket - reads the ticket the client presented and replies with whether the session can be resumed
+//
+// client: ticket length (2 bytes) + ticket + random
+// server: 0 = not resumed, carry on with the handshake, 1 = resumed followed by its own random
+// client: confirmation (see resumeConfirmation), sealed with the new key
+func (ss *Session) acceptTicket() error {
+	b := make([]byte, 2)
+	_, err := io.ReadFull(ss.conn, b)
+	if err != nil {
+		return errors.New("failed to receive session ticket")
+	}
+
+	b = make([]byte, int(binary.BigEndian.Uint16(b))+resumeRandomSize)
+	_, err = io.ReadFull(ss.conn, b)
+	if err != nil {
+		return errors.New("failed to receive session ticket")
+	}
+
+	ticket, clientRandom := b[:len(b)-resumeRandomSize], b[len(b)-resumeRandomSize:]
+
+	r, secret := ss.server.checkTicket(ticket)
+	if r == nil {
+		_, err = ss.conn.Write([]byte{0})
+		return err
+	}
+
+	serverRandom := make([]byte, resumeRandomSize)
+	_, err = io.ReadFull(rand.Reader, serverRandom)
+	if err != nil {
+		return err
+	}
+
+	_, err = ss.conn.Write(append([]byte{1}, serverRandom...))
+	if err != nil {
+		return errors.New("unable to send session ticket reply")
+	}
+
+	if ss.server.conf.Encryption {
+		ss.enc, err = resumeEncryption(r.curve, r.suite, secret, clientRandom, serverRandom, dirServer)
+		if err != nil {
+			return err
+		}
+	}
+
+	confirm, err := readSealed(ss.conn, ss.enc, sha256.Size)
+	if err != nil || !hmac.Equal(confirm, resumeConfirmation(secret, clientRandom, serverRandom)) {
+		return errors.New("the client couldn't confirm the session ticket")
+	}
+
+	if !ss.server.claimTicket(r, secret) {
+		return errors.New("the session ticket has already been used")
+	}
+
+	ss.resuming = r
+	ss.resumed = true
+
+	return nil
+}
+
+// checkTicket - returns the session the ticket is for and its secret, or nil if it isn't valid or the session has been
+// forgotten
+func (s *Server) checkTicket(ticket []byte) (*resumption, []byte) {
+	if s.tickets == nil {
+		return nil, nil
+	}
+
+	plain, err := decrypt(s.tickets, ticket)
+	if err != nil || len(plain) < 4 {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.resume[bytesToInt(plain[:4])]
+	if r == nil || subtle.ConstantTimeCompare(r.secret, plain[4:]) != 1 {
+		return nil, nil
+	}
+
+	return r, r.secret
+}
+
+// claimTicket - uses up the ticket once the client has confirmed it, returns false if the session has been forgotten
+// or resumed with the same ticket in the meantime
+func (s *Server) claimTicket(r *resumption, secret []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.resume[r.id] != r || subtle.ConstantTimeCompare(r.secret, secret) != 1 {
+		return false
+	}
+	r.secret = nil // a new ticket is issued once the session has been restored
+
+	if r.expiry != nil {
+		r.expiry.Stop()
+		r.expiry = nil
+	}
+
+	return true
+}
+
+// restore - carries on the session the client resumed, once the connection it had before has stopped
+func (ss *Session) restore() error {
+	r := ss.resuming
+
+	ss.ID = r.id
+	ss.clientID = r.id
+	ss.features, ss.proto, ss.comp = r.features, r.proto, r.comp
+	ss.peerKey = r.peerKey
+
+	ss.server.mu.Lock()
+	prev := r.owner
+	r.owner = ss
+	ss.server.mu.Unlock()
+
+	if prev != nil {
+		prev.conn.Close() // in case the server hasn't noticed the old connection has gone
+		<-prev.stopped
+	}
+
+	err := ss.startShm()
+	if err != nil {
+		return err
+	}
+
+	if ss.hasFeature(FeatureReliable) {
+		return ss.startReliable(ss.server.reliable(ss))
+	}
+
+	return nil
+}
+
+// suspend - keeps the session for ResumeTimeout after its connection has been lost, or forgets it if the client
+// closed the connection on purpose
+func (ss *Session) suspend() {
+	s := ss.server
+	if s.tickets == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.resume[ss.ID]
+	if r == nil || r.owner != ss {
+		return // already resumed on another connection
+	}
+
+	if ss.leaving.Load() || ss.status.get() == Closing || ss.status.get() == Closed {
+		delete(s.resume, ss.ID)
+		return
+	}
+
+	r.expiry = time.AfterFunc(s.conf.ResumeTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.resume[r.id] == r && r.expiry != nil {
+			delete(s.resume, r.id)
+		}
+	})
+}
+
+// presentTicket - asks to resume the session the client had before, returns false if the server didn't accept it
+// and the rest of the handshake has to be done
+func (c *Client) presentTicket() (bool, error) {
+	c.mu.Lock()
+	ticket, secret := c.ticket, c.secret
+	c.ticket, c.secret = nil, nil // each ticket is only used once
+	c.mu.Unlock()
+
+	// the resumed connection uses the cipher suite of the one the ticket came from
+	var curve Curve
+	suite := AES256GCM
+	if c.enc != nil {
+		curve, suite = c.enc.curve, c.enc.suite
+	}
+	c.enc = nil
+
+	clientRandom := make([]byte, resumeRandomSize)
+	_, err := io.ReadFull(rand.Reader, clientRandom)
+	if err != nil {
+		return false, err
+	}
+
+	b := []byte{4}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ticket)))
+	b = append(b, ticket...)
+	b = append(b, clientRandom...)
+
+	_, err = c.conn.Write(b)
+	if err != nil {
+		return false, errors.New("unable to send session ticket")
+	}
+
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(c.conn, reply)
+	if err != nil {
+		return false, errors.New("failed to receive session ticket reply")
+	}
+
+	if reply[0] != 1 {
+		return false, nil
+	}
+
+	serverRandom := make([]byte, resumeRandomSize)
+	_, err = io.ReadFull(c.conn, serverRandom)
+	if err != nil {
+		return false, errors.New("failed to receive session ticket reply")
+	}
+
+	if c.conf.Encryption {
+		c.enc, err = resumeEncryption(curve, suite, secret, clientRandom, serverRandom, dirClient)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = writeSealed(c.conn, c.enc, resumeConfirmation(secret, clientRandom, serverRandom))
+	if err != nil {
+		return false, errors.New("unable to confirm session ticket")
+	}
+
+	return true, nil
+}
+
+// resumeConfirmation - proves an end has the ticket's secret, it's only valid for the randoms of one connection
+func resumeConfirmation(secret, clientRandom, serverRandom []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("resume confirm"))
+	h.Write(clientRandom)
+	h.Write(serverRandom)
+
+	return h.Sum(nil)
+}
+
+// resumeEncryption - the key of a resumed connection is derived from the ticket's secret and a random value from each end
+func resumeEncryption(curve Curve, suite CipherSuite, secret, clientRandom, serverRandom []byte, dir byte) (*encryption, error) {
+	return newEncryption(curve, suite, secret, nil, transcriptHash([]byte("resume"), clientRandom, serverRandom), dir)
+}
@@ -0,0 +1,117 @@
+//go:build linux || darwin
+
+package ipc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// presentTicket - connects to an unencrypted server and presents a ticket with the confirmation made from secret,
+// returns whether the server resumed the session
+func presentTicket(t *testing.T, name string, ticket, secret []byte) bool {
+	t.Helper()
+
+	conn, err := net.Dial("unix", socketPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 2)
+	io.ReadFull(conn, b)
+
+	clientRandom := make([]byte, resumeRandomSize)
+	rand.Read(clientRandom)
+
+	b = binary.BigEndian.AppendUint16([]byte{4}, uint16(len(ticket)))
+	b = append(b, ticket...)
+	conn.Write(append(b, clientRandom...))
+
+	reply := make([]byte, 1+resumeRandomSize)
+	_, err = io.ReadFull(conn, reply[:1])
+	if err != nil || reply[0] != 1 {
+		return false
+	}
+	io.ReadFull(conn, reply[1:])
+
+	err = writeSealed(conn, nil, resumeConfirmation(secret, clientRandom, reply[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server closes the connection if it doesn't accept the confirmation
+	_, err = conn.Read(make([]byte, 1))
+	return err == nil
+}
+
+// a client that loses its connection carries on the same session
+func TestResume(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprint("encrypted=", encrypted), func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{Encryption: encrypted, ResumeTimeout: time.Second, Reliable: true},
+				&ClientConfig{Encryption: encrypted, Reliable: true})
+			ss := s.Sessions()[0]
+			waitForTicket(t, c)
+
+			ss.conn.Close()
+			waitFor(t, cr, isStatus(Resumed))
+			waitFor(t, sr, isStatus(Resumed))
+
+			if id := s.Sessions()[0].ID; id != ss.ID {
+				t.Fatalf("resumed session %d, expected %d", id, ss.ID)
+			}
+
+			exchange(t, c.Write, sr, "to server")
+			exchange(t, s.Write, cr, "to client")
+		})
+	}
+}
+
+// a session that has been disconnected for longer than ResumeTimeout can't be resumed
+func TestResumeExpired(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{MultiClient: true, ResumeTimeout: 20 * time.Millisecond},
+		&ClientConfig{DisableReconnect: true})
+	ticket, secret := waitForTicket(t, c)
+
+	s.Sessions()[0].conn.Close()
+	waitFor(t, cr, isStatus(Disconnected))
+	waitFor(t, sr, isStatus(Disconnected))
+	time.Sleep(100 * time.Millisecond)
+
+	if presentTicket(t, s.Name, ticket, secret) {
+		t.Fatal("an expired session was resumed")
+	}
+}
+
+// a ticket can only be used once, and only by a client that has its secret
+func TestResumeReplay(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{MultiClient: true, ResumeTimeout: time.Second}, &ClientConfig{})
+	ticket, secret := waitForTicket(t, c)
+
+	// the ticket is sent in the clear, without the secret it doesn't take the session from its client
+	if presentTicket(t, s.Name, ticket, make([]byte, len(secret))) {
+		t.Fatal("a session was resumed without the ticket's secret")
+	}
+	waitFor(t, sr, func(m *Message) bool { return m.Err != nil })
+
+	if status := s.Sessions()[0].Status(); status != Connected {
+		t.Fatalf("the session is %s", status.String())
+	}
+	exchange(t, s.Sessions()[0].Write, cr, "still connected")
+
+	s.Sessions()[0].conn.Close()
+	waitFor(t, cr, isStatus(Resumed))
+	waitFor(t, sr, isStatus(Resumed))
+
+	if presentTicket(t, s.Name, ticket, secret) {
+		t.Fatal("a ticket was used twice")
+	}
+	exchange(t, c.Write, sr, "to server")
+}
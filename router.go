@@ -0,0 +1,146 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+)
+
+// NewRouter - creates a router that runs up to maxConcurrent handlers at the same time.
+// if maxConcurrent is less than 1 handlers are run one at a time in the order the messages were received.
+func NewRouter(maxConcurrent int) *Router {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	return &Router{
+		handlers: make(map[int]HandlerFunc),
+		sem:      make(chan struct{}, maxConcurrent),
+	}
+}
+
+// HandleFunc - registers the handler for msgType, a nil handler removes it.
+func (r *Router) HandleFunc(msgType int, handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if handler == nil {
+		delete(r.handlers, msgType)
+	} else {
+		r.handlers[msgType] = handler
+	}
+}
+
+// HandleFallback - registers the handler for messages that don't have a handler for their type.
+// without a fallback handler those messages are dropped.
+func (r *Router) HandleFallback(handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = handler
+}
+
+// OnStatusChange - sets the function called when the status of the connection changes.
+// clientID is the session the status belongs to, or 0 for the server or client itself.
+func (r *Router) OnStatusChange(fn func(clientID int, status Status)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onStatus = fn
+}
+
+// OnError - sets the function called with any errors received from the connection
+func (r *Router) OnError(fn func(clientID int, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onError = fn
+}
+
+// OnEvent - sets the function called with the events received from the connection, such as each attempt to reconnect
+func (r *Router) OnEvent(fn func(clientID int, e *Event)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onEvent = fn
+}
+
+// Serve - reads every message received by the server and passes it to the router, blocks until ctx is done or the server is closed.
+// Read should not be called while the server is being served.
+func (s *Server) Serve(ctx context.Context, r *Router) error {
+	return r.serve(ctx, s.received, &s.running)
+}
+
+// Serve - reads every message received by the client and passes it to the router, blocks until ctx is done.
+// Read should not be called while the client is being served.
+func (c *Client) Serve(ctx context.Context, r *Router) error {
+	return r.serve(ctx, c.received, &c.running)
+}
+
+// serve - waits for any handlers that are still running before returning
+func (r *Router) serve(ctx context.Context, received chan *Message, running *running) error {
+	defer r.wg.Wait()
+
+	for {
+		select {
+		case m, ok := <-received:
+			if !ok {
+				return errors.New("the received channel has been closed")
+			}
+
+			r.route(ctx, m, running)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *Router) route(ctx context.Context, m *Message, running *running) {
+	r.mu.RLock()
+	onStatus, onError, onEvent := r.onStatus, r.onError, r.onEvent
+	handler, ok := r.handlers[m.MsgType]
+	if !ok {
+		handler = r.fallback
+	}
+	r.mu.RUnlock()
+
+	switch {
+	case m.Err != nil:
+		if onError != nil {
+			onError(m.ClientID, m.Err)
+		}
+
+	case m.Event != nil:
+		if onEvent != nil {
+			onEvent(m.ClientID, m.Event)
+		}
+
+	case m.MsgType < 0:
+		if onStatus != nil {
+			onStatus(m.ClientID, statusFromString(m.Status))
+		}
+
+	case handler != nil:
+		select {
+		case r.sem <- struct{}{}:
+		case <-ctx.Done():
+			m.discard()
+			return
+		}
+
+		r.wg.Add(1)
+		running.add()
+		go func() {
+			defer func() {
+				<-r.sem
+				running.done()
+				r.wg.Done()
+			}()
+
+			handler(ctx, m)
+		}()
+
+	default:
+		m.discard() // nothing handles the message type
+	}
+}
@@ -1,27 +1,41 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
-	"io"
-	"log"
-	"time"
+	"fmt"
+	"net"
+	"sort"
 )
 
 // StartServer - starts the ipc server.
 //
 // ipcName - is the name of the unix socket or named pipe that will be created, the client needs to use the same name
 func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
+	return StartServerContext(context.Background(), ipcName, config)
+}
+
+// StartServerContext - starts the ipc server, the server and all of its connections are closed once ctx is done.
+// Any messages that haven't been read by then are dropped.
+func StartServerContext(ctx context.Context, ipcName string, config *ServerConfig) (*Server, error) {
 	err := checkIpcName(ipcName)
 	if err != nil {
 		return nil, err
 	}
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
 	s := &Server{
 		Name:     ipcName,
-		status:   NotConnected,
+		ctx:      ctx,
+		done:     make(chan struct{}),
 		received: make(chan *Message),
-		sent:     make(chan *Message),
+		sessions: make(map[int]*Session),
+		handlers: newCallHandlers(),
+		controls: newControlHandlers(),
+		accept:   make(chan *stream, acceptQueueSize),
 	}
 
 	if config == nil {
@@ -33,16 +47,46 @@ func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
 	if s.conf.Timeout < 0 {
 		s.conf.Timeout = DefaultServerConfig.Timeout
 	}
+	if s.conf.CompressMin <= 0 {
+		s.conf.CompressMin = defaultCompressMin
+	}
+	if s.conf.SharedMemorySize <= 0 || s.conf.SharedMemorySize > maxShmSize {
+		s.conf.SharedMemorySize = defaultShmSize
+	}
 	if s.conf.MaxMsgSize < minMsgSize {
 		s.conf.MaxMsgSize = DefaultServerConfig.MaxMsgSize
 	}
 	if s.conf.SocketBasePath == "" {
 		s.conf.SocketBasePath = DefaultServerConfig.SocketBasePath
 	}
+	if s.conf.Codec == nil {
+		s.conf.Codec = DefaultServerConfig.Codec
+	}
+	if s.conf.authenticates() && !s.conf.Encryption {
+		return nil, errors.New("authentication needs encryption to be turned on")
+	}
+
+	err = s.startTickets()
+	if err != nil {
+		return nil, err
+	}
 
 	err = s.run()
+	if err != nil {
+		return s, err
+	}
 
-	return s, err
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Close()
+			case <-s.done:
+			}
+		}()
+	}
+
+	return s, nil
 }
 
 func (s *Server) acceptLoop() {
@@ -52,133 +96,180 @@ func (s *Server) acceptLoop() {
 			break
 		}
 
-		if s.status == Listening || s.status == Disconnected {
-			s.conn = conn
-
-			err2 := s.handshake()
-			if err2 != nil {
-				s.received <- &Message{Err: err2, MsgType: -2}
-				s.status = Error
-				s.listen.Close()
-				s.conn.Close()
-			} else {
-				go s.read()
-				go s.write()
-
-				s.status = Connected
-				s.received <- &Message{Status: s.status.String(), MsgType: -1}
-				s.connected <- true
-			}
+		if !s.conf.MultiClient && s.status.get() != Listening && s.status.get() != Disconnected {
+			conn.Close() // only one client at a time
+
+			continue
+		}
+
+		cred, err := s.authorize(conn)
+		if err != nil {
+			conn.Close()
+			s.notify(&Message{Err: err, MsgType: -2})
+
+			continue
+		}
+
+		ss := s.newSession(conn)
+		ss.peer = cred
+
+		if s.conf.MultiClient {
+			go s.startSession(ss)
+		} else {
+			s.startSession(ss)
 		}
 	}
 }
 
-// func (sc *Server) connectionTimer() error {
-// 	if sc.conf.Timeout != 0 {
-// 		ticker := time.NewTicker(sc.conf.Timeout)
-// 		defer ticker.Stop()
+func (s *Server) newSession(conn net.Conn) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+
+	ss := &Session{
+		ID:      s.lastID,
+		server:  s,
+		stopped: make(chan struct{}),
+		link: link{
+			conn:     conn,
+			received: s.received,
+			sent:     make(chan *Message, sendQueueSize),
+			frames:   make(chan *Message, sendQueueSize),
+			done:     make(chan struct{}),
+			codec:    s.conf.Codec,
+			handlers: s.handlers,
+			controls: s.controls,
+			maxSize:  s.conf.MaxMsgSize,
+			accept:   s.accept,
+			clientID: s.lastID,
+			name:     s.Name,
+			rekeyAt:  s.conf.Rekey,
+			compMin:  s.conf.CompressMin,
+		},
+	}
+	ss.status.set(Connecting)
 
-// 		select {
+	return ss
+}
 
-// 		case <-sc.connChannel:
-// 			return nil
-// 		case <-ticker.C:
-// 			sc.listen.Close()
-// 			return errors.New("Timed out waiting for client to connect")
-// 		}
-// 	}
+func (s *Server) startSession(ss *Session) {
+	err := ss.handshake()
+	if err != nil {
+		close(ss.stopped)
+		ss.status.set(Error)
+		ss.conn.Close()
+		s.notify(&Message{Err: err, MsgType: -2, ClientID: ss.ID})
+
+		if !s.conf.MultiClient {
+			s.status.set(Error)
+			s.listen.Close()
+		}
 
-// 	select {
+		return
+	}
 
-// 	case <-sc.connChannel:
-// 		return nil
-// 	}
+	// checked under mu so either Close sees the session or the session sees the server closing
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		close(ss.stopped)
+		ss.status.set(Closed)
+		ss.conn.Close()
+
+		return
+	default:
+	}
+	ss.status.set(Connected)
+	s.sessions[ss.ID] = ss
+	s.mu.Unlock()
 
-// }
+	go ss.read()
+	go ss.write()
 
-func (s *Server) read() {
-	bLen := make([]byte, 4)
+	err = ss.issueTicket()
+	if err != nil {
+		s.notify(&Message{Err: err, MsgType: -2, ClientID: ss.ID})
+	}
 
-	for {
-		res := s.readData(bLen)
-		if !res {
-			s.conn.Close()
+	if !s.conf.MultiClient {
+		s.status.set(Connected)
+	}
 
-			break
-		}
+	status := ss.status.get()
+	if ss.resumed {
+		status = Resumed
+	}
+	s.notify(&Message{Status: status.String(), MsgType: -1, ClientID: ss.ID})
+}
 
-		mLen := bytesToInt(bLen)
-		msgRecvd := make([]byte, mLen)
-		res = s.readData(msgRecvd)
-		if !res {
-			s.conn.Close()
+// removeSession - called once a session has been disconnected or closed
+func (s *Server) removeSession(ss *Session) {
+	s.mu.Lock()
+	delete(s.sessions, ss.ID)
+	s.mu.Unlock()
 
-			break
-		}
+	if !s.conf.MultiClient && s.status.get() != Closing && s.status.get() != Closed {
+		s.status.set(Disconnected)
+	}
+}
 
-		if s.conf.Encryption {
-			msgFinal, err := decrypt(*s.enc.cipher, msgRecvd)
-			if err != nil {
-				s.received <- &Message{Err: err, MsgType: -1}
+// Session - returns the connected session with the given id, or nil if there isn't one
+func (s *Server) Session(id int) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-				continue
-			}
+	return s.sessions[id]
+}
 
-			if bytesToInt(msgFinal[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				s.received <- &Message{Data: msgFinal[4:], MsgType: bytesToInt(msgFinal[:4])}
-			}
+// Sessions - returns all of the currently connected sessions ordered by id
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		} else {
-			if bytesToInt(msgRecvd[:4]) == 0 {
-				//  type 0 = control message
-			} else {
-				s.received <- &Message{Data: msgRecvd[4:], MsgType: bytesToInt(msgRecvd[:4])}
-			}
-		}
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
 	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	return sessions
 }
 
-func (s *Server) readData(buff []byte) bool {
-	_, err := io.ReadFull(s.conn, buff)
-	if err != nil {
-		if s.status == Closing {
-			s.status = Closed
-			s.received <- &Message{Status: s.status.String(), MsgType: -1}
-			s.received <- &Message{Err: errors.New("server has closed the connection"), MsgType: -1}
-			return false
-		}
+// current - returns the session of the connected client when not running in MultiClient mode
+func (s *Server) current() *Session {
+	if s.conf.MultiClient {
+		return nil
+	}
 
-		if err == io.EOF {
-			s.status = Disconnected
-			s.received <- &Message{Status: s.status.String(), MsgType: -1}
-			return false
-		}
+	sessions := s.Sessions()
+	if len(sessions) == 0 {
+		return nil
 	}
 
-	return true
+	return sessions[0]
 }
 
-//func (sc *Server) reConnect() {
-//	sc.status = ReConnecting
-//	sc.received <- &Message{Status: sc.status.String(), MsgType: -1}
-//
-//	err := sc.connectionTimer()
-//	if err != nil {
-//		sc.status = Timeout
-//		sc.received <- &Message{Status: sc.status.String(), MsgType: -1}
-//
-//		sc.received <- &Message{err: err, MsgType: -2}
-//	}
-//}
-
 // Read - blocking function, reads each message recieved
 // if MsgType is a negative number its an internal message
 func (s *Server) Read() (*Message, error) {
-	m, ok := (<-s.received)
-	if !ok {
-		return nil, errors.New("the received channel has been closed")
+	return s.ReadContext(context.Background())
+}
+
+// ReadContext - the same as Read but returns ctx.Err() if ctx is done before a message is received
+func (s *Server) ReadContext(ctx context.Context) (*Message, error) {
+	var m *Message
+	var ok bool
+
+	select {
+	case m, ok = <-s.received:
+		if !ok {
+			return nil, errors.New("the received channel has been closed")
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	if m.Err != nil {
@@ -190,87 +281,139 @@ func (s *Server) Read() (*Message, error) {
 
 // Write - writes a message to the ipc connection
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
+//
+// In MultiClient mode use WriteTo or Broadcast instead.
 func (s *Server) Write(msgType int, message []byte) error {
-	if msgType == 0 {
-		return errors.New("message type 0 is reserved")
+	return s.WriteContext(context.Background(), msgType, message)
+}
+
+// WriteContext - the same as Write but returns ctx.Err() if ctx is done before the message could be queued
+func (s *Server) WriteContext(ctx context.Context, msgType int, message []byte) error {
+	if s.conf.MultiClient {
+		return errors.New("server is in multi client mode, use WriteTo or Broadcast instead")
 	}
 
-	mlen := len(message)
+	ss := s.current()
+	if ss == nil {
+		return errors.New(s.status.String())
+	}
+
+	return ss.WriteContext(ctx, msgType, message)
+}
 
-	if mlen > s.conf.MaxMsgSize {
-		return errors.New("message exceeds maximum message length")
+// notify - passes a message to Read, gives up once the server has been closed or the context it was started with is done
+func (s *Server) notify(m *Message) {
+	s.notifyMu.RLock()
+	defer s.notifyMu.RUnlock()
+
+	select {
+	case <-s.done:
+		m.discard()
+		return
+	default:
 	}
 
-	if s.status == Connected {
-		s.sent <- &Message{MsgType: msgType, Data: message}
-	} else {
-		return errors.New(s.status.String())
+	select {
+	case s.received <- m:
+	case <-s.done:
+		m.discard()
+	case <-s.ctx.Done():
+		m.discard()
 	}
+}
 
-	return nil
+// Call - sends a request to the connected client and waits for the reply from the handler registered for msgType.
+// returns a *RemoteError if the handler failed, or ctx.Err() if ctx is done before the reply arrives.
+//
+// In MultiClient mode use Session.Call instead.
+func (s *Server) Call(ctx context.Context, msgType int, request []byte) ([]byte, error) {
+	if s.conf.MultiClient {
+		return nil, errors.New("server is in multi client mode, use Session.Call instead")
+	}
+
+	ss := s.current()
+	if ss == nil {
+		return nil, errors.New(s.status.String())
+	}
+
+	return ss.Call(ctx, msgType, request)
 }
 
-func (s *Server) write() {
-	var err error
-	for {
-		m, ok := <-s.sent
-		if !ok {
-			break
-		}
+// HandleCall - registers the handler for calls made by clients to msgType, a nil handler removes it.
+func (s *Server) HandleCall(msgType int, handler CallHandler) {
+	s.handlers.set(msgType, handler)
+}
 
-		toSend := intToBytes(m.MsgType)
-		writer := bufio.NewWriter(s.conn)
+// WriteTo - writes a message to the client with the given id, blocks while that client's send queue is full.
+// The message is sent once it has been queued, if sending it fails Read returns a *SendError and the session is
+// disconnected.
+func (s *Server) WriteTo(clientID int, msgType int, message []byte) error {
+	ss := s.Session(clientID)
+	if ss == nil {
+		return fmt.Errorf("client %d is not connected", clientID)
+	}
 
-		if s.conf.Encryption {
-			toSend = append(toSend, m.Data...)
-			toSend, err = encrypt(*s.enc.cipher, toSend)
-			if err != nil {
-				log.Println("error encrypting data", err)
+	return ss.Write(msgType, message)
+}
 
-				continue
-			}
-		} else {
-			toSend = append(toSend, m.Data...)
-		}
+// Broadcast - writes a message to every connected client.
+// Clients whose send queue is full are skipped rather than waited for, if the message could not be
+// queued for one or more clients a *BroadcastError is returned with the error for each of them.
+// Failures sending a message that was queued are reported by Read in the same way as for WriteTo.
+func (s *Server) Broadcast(msgType int, message []byte) error {
+	var errs map[int]error
 
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
-		err = writer.Flush()
+	for _, ss := range s.Sessions() {
+		err := ss.tryWrite(msgType, message)
 		if err != nil {
-			log.Println("error flushing data", err)
-
-			continue
+			if errs == nil {
+				errs = make(map[int]error)
+			}
+			errs[ss.ID] = err
 		}
+	}
 
-		time.Sleep(2 * time.Millisecond)
+	if errs != nil {
+		return &BroadcastError{Errs: errs}
 	}
+
+	return nil
 }
 
 // Status - returns the current connection status
 func (s *Server) Status() Status {
-	return s.status
+	return s.status.get()
 }
 
 // Close - closes the connection
 func (s *Server) Close() {
-	s.status = Closing
+	if !s.status.change(Closing, Closing) {
+		return
+	}
+
+	s.doneOnce.Do(func() { close(s.done) })
 
 	if s.listen != nil {
 		s.listen.Close()
 	}
 
-	if s.conn != nil {
-		s.conn.Close()
+	for _, ss := range s.Sessions() {
+		ss.Close()
 	}
 
 	if s.received != nil {
-		s.received <- &Message{Status: s.status.String(), MsgType: -1}
-		s.received <- &Message{Err: errors.New("Server has closed the connection"), MsgType: -2}
+		for _, m := range []*Message{
+			{Status: s.status.String(), MsgType: -1},
+			{Err: errors.New("Server has closed the connection"), MsgType: -2},
+		} {
+			select {
+			case s.received <- m:
+			case <-s.ctx.Done():
+			}
+		}
 
+		s.notifyMu.Lock()
 		close(s.received)
-	}
-
-	if s.sent != nil {
-		close(s.sent)
+		s.notifyMu.Unlock()
 	}
 }
@@ -0,0 +1,129 @@
+package ipc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// a client that has stopped reading doesn't hold up Broadcast or writes to the other clients
+func TestBroadcastStalled(t *testing.T) {
+	name := testName()
+
+	s, err := StartServer(name, &ServerConfig{MultiClient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sr := messages(s.ReadContext)
+
+	a, err := StartClient(name, &ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	ar := messages(a.ReadContext)
+	waitFor(t, ar, isStatus(Connected))
+
+	a.Write(5, nil)
+	aID := waitFor(t, sr, isMsg(5)).ClientID
+
+	stalled, err := StartClient(name, &ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		m, err := stalled.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isStatus(Connected)(m) {
+			break // and isn't read from again
+		}
+	}
+	waitFor(t, sr, isStatus(Connected))
+
+	var stalledID int
+	for _, ss := range s.Sessions() {
+		if ss.ID != aID {
+			stalledID = ss.ID
+		}
+	}
+
+	// blocks once the stalled client's send queue is full
+	blocked := make(chan error)
+	go func() {
+		var err error
+		for err == nil {
+			err = s.WriteTo(stalledID, 7, make([]byte, 64*1024))
+		}
+		blocked <- err
+	}()
+
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	skipped := 0
+	for range 200 {
+		start := time.Now()
+		err := s.Broadcast(6, data)
+		if time.Since(start) > time.Second {
+			t.Fatalf("broadcasting took %s", time.Since(start))
+		}
+
+		var berr *BroadcastError
+		if errors.As(err, &berr) {
+			if len(berr.Errs) != 1 || berr.Errs[stalledID] == nil {
+				t.Fatalf("broadcast failed for %v", berr.Errs)
+			}
+			skipped++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		waitFor(t, ar, isMsg(6))
+	}
+	if skipped == 0 {
+		t.Fatal("the stalled client's send queue never filled")
+	}
+
+	err = s.WriteTo(aID, 8, []byte("not held up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ar, isMsg(8))
+
+	stalled.Close()
+	if err := <-blocked; err == nil {
+		t.Fatal("WriteTo a closed client succeeded")
+	}
+}
+
+// a message that can't be sent once it has been queued is reported with the client it was for
+func TestWriteFailure(t *testing.T) {
+	s, sr, _, _ := start(t, &ServerConfig{MultiClient: true}, &ClientConfig{DisableReconnect: true})
+	ss := s.Sessions()[0]
+
+	conn, ok := ss.conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Skip("the connection can't be closed for writing only")
+	}
+	conn.CloseWrite()
+
+	err := ss.Write(5, []byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := waitFor(t, sr, func(m *Message) bool { return m.Err != nil })
+
+	var se *SendError
+	if !errors.As(m.Err, &se) || se.ClientID != ss.ID || se.MsgType != 5 {
+		t.Fatalf("unexpected error %v", m.Err)
+	}
+
+	select {
+	case <-ss.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session wasn't disconnected")
+	}
+}
@@ -0,0 +1,199 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+)
+
+func (ss *Session) read() {
+	stop := ss.startHeartbeat(ss.server.conf.Heartbeat, ss.server.conf.HeartbeatMisses, ss.peerTimeout)
+	defer close(stop)
+
+	for {
+		m, err := ss.readMsg()
+		if err != nil {
+			ss.conn.Close()
+			ss.readError(err)
+
+			break
+		}
+
+		if m == nil {
+			continue
+		}
+
+		m.ClientID = ss.ID
+		m.PeerCred = ss.peer
+
+		if !ss.inOrder(m) {
+			continue
+		}
+
+		if ss.dispatchCall(m) {
+			continue
+		}
+
+		ss.server.notify(m)
+	}
+}
+
+func (ss *Session) readError(err error) {
+	if ss.rel != nil {
+		ss.rel.pause()
+	}
+	ss.failCalls(errors.New("the connection has been lost"))
+	ss.failStreams(errors.New("the connection has been lost"))
+
+	if ss.server.status.get() == Closing || !ss.status.change(Disconnected, Closing, Closed) {
+		// closed from this end, Close reports the change of status
+		return
+	}
+	if ss.leaving.Load() {
+		ss.status.set(Closed) // the client closed the connection on purpose
+	}
+	ss.suspend()
+	ss.server.removeSession(ss)
+	ss.closeDone()
+
+	ss.server.notify(&Message{Status: ss.status.String(), MsgType: -1, ClientID: ss.ID})
+}
+
+// Write - writes a message to the client connected to this session
+// msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
+func (ss *Session) Write(msgType int, message []byte) error {
+	return ss.WriteContext(context.Background(), msgType, message)
+}
+
+// WriteContext - the same as Write but returns ctx.Err() if ctx is done before the message could be queued
+func (ss *Session) WriteContext(ctx context.Context, msgType int, message []byte) error {
+	err := ss.checkWrite(msgType, message)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ss.sent <- &Message{MsgType: msgType, Data: message}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ss.done:
+		return errors.New(ss.status.String())
+	}
+
+	return nil
+}
+
+// Call - sends a request to the client and waits for the reply from the handler registered for msgType.
+// returns a *RemoteError if the handler failed, or ctx.Err() if ctx is done before the reply arrives.
+func (ss *Session) Call(ctx context.Context, msgType int, request []byte) ([]byte, error) {
+	err := ss.checkWrite(msgType, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.call(ctx, msgType, request)
+}
+
+// tryWrite - queues a message without blocking, fails if the session's send queue is full
+func (ss *Session) tryWrite(msgType int, message []byte) error {
+	err := ss.checkWrite(msgType, message)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ss.sent <- &Message{MsgType: msgType, Data: message}:
+	case <-ss.done:
+		return errors.New(ss.status.String())
+	default:
+		return errors.New("send queue is full")
+	}
+
+	return nil
+}
+
+func (ss *Session) checkWrite(msgType int, message []byte) error {
+	if msgType == 0 {
+		return errors.New("message type 0 is reserved")
+	}
+
+	if msgType < 0 || msgType > maxMsgType {
+		return errors.New("message type is out of range")
+	}
+
+	mlen := len(message)
+
+	if mlen > ss.server.conf.MaxMsgSize {
+		return errors.New("message exceeds maximum message length")
+	}
+
+	if ss.status.get() != Connected {
+		return errors.New(ss.status.String())
+	}
+
+	if ss.draining.Load() {
+		return errShuttingDown
+	}
+
+	return nil
+}
+
+func (ss *Session) write() {
+	defer close(ss.stopped)
+
+	for {
+		m, ok := ss.next()
+		if !ok {
+			ss.keepUnsent(nil)
+			return
+		}
+
+		if m.flushed != nil {
+			ss.writeFrames()
+			close(m.flushed)
+			continue
+		}
+
+		if !ss.sequence(m) {
+			ss.keepUnsent(m)
+			return
+		}
+
+		err := ss.writeMsg(m)
+		if err != nil {
+			// the frame may have been cut short so nothing more can be sent, the reader stops the session once it
+			// notices the connection has been closed
+			status := ss.status.get()
+			ss.conn.Close()
+			if status != Closing && status != Closed {
+				ss.server.notify(&Message{Err: &SendError{ClientID: ss.ID, MsgType: m.MsgType, Err: err}, MsgType: -2, ClientID: ss.ID})
+			}
+
+			<-ss.done
+			ss.keepUnsent(nil)
+			return
+		}
+	}
+}
+
+// closeDone - closes done, it can be reached from both Close and the reader once the connection has been lost
+func (ss *Session) closeDone() {
+	ss.doneOnce.Do(func() { close(ss.done) })
+}
+
+// Status - returns the current status of the session
+func (ss *Session) Status() Status {
+	return ss.status.get()
+}
+
+// Close - closes the connection to this client
+func (ss *Session) Close() {
+	if !ss.status.change(Closing, Closing, Closed, Disconnected) {
+		return // a disconnected session has already been closed when its connection was lost
+	}
+	ss.suspend()
+	ss.conn.Close()
+	ss.closeDone()
+
+	ss.status.set(Closed)
+	ss.server.removeSession(ss)
+}
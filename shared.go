@@ -1,6 +1,12 @@
 package ipc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
 
 // returns the status of the connection as a string
 func (status *Status) String() string {
@@ -25,11 +31,50 @@ func (status *Status) String() string {
 		return "Error"
 	case Disconnected:
 		return "Disconnected"
+	case Resumed:
+		return "Resumed"
 	default:
 		return "Status not found"
 	}
 }
 
+func (s *state) get() Status {
+	return Status(s.v.Load())
+}
+
+func (s *state) set(status Status) {
+	s.v.Store(int32(status))
+}
+
+// change - sets the status to to unless it's one of from, returns false if it was
+func (s *state) change(to Status, from ...Status) bool {
+	for {
+		old := s.v.Load()
+		if slices.Contains(from, Status(old)) {
+			return false
+		}
+		if s.v.CompareAndSwap(old, int32(to)) {
+			return true
+		}
+	}
+}
+
+func (s *state) String() string {
+	status := s.get()
+	return status.String()
+}
+
+// returns the status a status message was created from
+func statusFromString(s string) Status {
+	for status := NotConnected; status <= Resumed; status++ {
+		if status.String() == s {
+			return status
+		}
+	}
+
+	return Error
+}
+
 // checks the name passed into the start function to ensure it's ok/will work.
 func checkIpcName(ipcName string) error {
 	if len(ipcName) == 0 {
@@ -38,3 +83,26 @@ func checkIpcName(ipcName string) error {
 
 	return nil
 }
+
+func (e *BroadcastError) Error() string {
+	ids := make([]int, 0, len(e.Errs))
+	for id := range e.Errs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("client %d: %s", id, e.Errs[id])
+	}
+
+	return "broadcast failed for " + strings.Join(msgs, ", ")
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("unable to send message type %d to client %d: %s", e.MsgType, e.ClientID, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,372 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// shared memory - when both ends ask for it (linux only) the server makes a memfd holding a ring buffer for each
+// direction and passes it to the client over the socket, along with an eventfd for the reader and the writer of each
+// ring. Once the client has mapped it the frames go through the rings instead of the socket, which is only watched to
+// notice when the other end has gone and to carry descriptors sent with WriteWithFDs. An eventfd is only signalled while the other end is waiting on it, so a busy
+// connection doesn't make any system calls.
+//
+// sent at the end of the handshake, each with writeSealed so they're encrypted along with the rest of it:
+// server: 0 = carry on over the socket, or 1 + ring size (4 bytes) with the memfd and eventfds attached
+// client: 0 = switched to shared memory, 1 = carry on over the socket
+
+// startShm - moves the session to shared memory if both ends agreed to, it carries on over the socket if it can't
+func (ss *Session) startShm() error {
+	if !ss.hasFeature(FeatureShm) {
+		return nil
+	}
+
+	conn, err := offerShm(ss.conn, ss.enc, ss.server.conf.SharedMemorySize)
+	if err != nil {
+		return err
+	}
+
+	if conn == nil {
+		ss.features = withoutShm(ss.features)
+		return nil
+	}
+
+	ss.conn = conn
+
+	return nil
+}
+
+// startShm - moves the connection to shared memory if the server sends it, see Session.startShm
+func (c *Client) startShm() error {
+	if !c.hasFeature(FeatureShm) {
+		return nil
+	}
+
+	conn, err := acceptShm(c.conn, c.enc)
+	if err != nil {
+		return err
+	}
+
+	if conn == nil {
+		c.features = withoutShm(c.features)
+		return nil
+	}
+
+	c.setConn(conn)
+
+	return nil
+}
+
+func withoutShm(features []string) []string {
+	return slices.DeleteFunc(slices.Clone(features), func(f string) bool { return f == FeatureShm })
+}
+
+// ring - a single producer, single consumer queue of bytes in shared memory, the producer and consumer are in
+// different processes
+//
+// byte 0-7     = bytes written, only changed by the producer
+// byte 64-71   = bytes read, only changed by the consumer
+// byte 128-131 = set while the consumer is waiting for data
+// byte 132-135 = set while the producer is waiting for space
+// byte 4096-   = data
+type ring struct {
+	data          []byte
+	head          *atomic.Uint64
+	tail          *atomic.Uint64
+	readerWaiting *atomic.Uint32
+	writerWaiting *atomic.Uint32
+	dataBell      *os.File // eventfd the producer signals when it has written while the consumer is waiting
+	spaceBell     *os.File // eventfd the consumer signals when it has read while the producer is waiting
+}
+
+func newRing(mem []byte, dataBell, spaceBell *os.File) *ring {
+	return &ring{
+		data:          mem[shmHeaderSize:],
+		head:          (*atomic.Uint64)(unsafe.Pointer(&mem[0])),
+		tail:          (*atomic.Uint64)(unsafe.Pointer(&mem[64])),
+		readerWaiting: (*atomic.Uint32)(unsafe.Pointer(&mem[128])),
+		writerWaiting: (*atomic.Uint32)(unsafe.Pointer(&mem[132])),
+		dataBell:      dataBell,
+		spaceBell:     spaceBell,
+	}
+}
+
+// read - copies as much as is waiting into p, returns 0 if the ring is empty
+func (r *ring) read(p []byte) int {
+	tail := r.tail.Load()
+	n := int(min(r.head.Load()-tail, uint64(len(p))))
+	if n == 0 {
+		return 0
+	}
+
+	i := int(tail % uint64(len(r.data)))
+	c := copy(p[:n], r.data[i:])
+	copy(p[c:n], r.data)
+
+	r.tail.Store(tail + uint64(n))
+	if r.writerWaiting.CompareAndSwap(1, 0) {
+		ringBell(r.spaceBell)
+	}
+
+	return n
+}
+
+// write - copies as much of p as there is room for, returns 0 if the ring is full
+func (r *ring) write(p []byte) int {
+	head := r.head.Load()
+	n := int(min(uint64(len(r.data))-(head-r.tail.Load()), uint64(len(p))))
+	if n == 0 {
+		return 0
+	}
+
+	i := int(head % uint64(len(r.data)))
+	c := copy(r.data[i:], p[:n])
+	copy(r.data, p[c:n])
+
+	r.head.Store(head + uint64(n))
+	if r.readerWaiting.CompareAndSwap(1, 0) {
+		ringBell(r.dataBell)
+	}
+
+	return n
+}
+
+// waitBell - blocks until the eventfd has been signalled
+func waitBell(bell *os.File) error {
+	var b [8]byte
+	_, err := bell.Read(b[:])
+
+	return err
+}
+
+func ringBell(bell *os.File) {
+	bell.Write(binary.NativeEndian.AppendUint64(nil, 1))
+}
+
+// shmConn - a net.Conn that reads from one ring and writes to the other, the socket it embeds is kept open so each end
+// notices when the other has gone
+type shmConn struct {
+	net.Conn
+	in       *ring
+	out      *ring
+	mem      []byte
+	bells    []*os.File
+	mu       sync.RWMutex // held for reading while the rings are being used, released unmaps them
+	released bool
+	peerGone atomic.Bool
+	fmu      sync.Mutex
+	files    []*os.File    // descriptors received on the socket, taken in order by the frames they were sent with
+	arrived  chan struct{} // closed when more descriptors have arrived or the other end has gone
+}
+
+// newShmConn - mem holds the ring from the client to the server followed by the one from the server to the client,
+// bells are the data and space eventfds of each ring in the same order
+func newShmConn(conn net.Conn, mem []byte, bells []*os.File, server bool) *shmConn {
+	half := len(mem) / 2
+	toServer := newRing(mem[:half], bells[0], bells[1])
+	toClient := newRing(mem[half:], bells[2], bells[3])
+
+	c := &shmConn{Conn: conn, in: toClient, out: toServer, mem: mem, bells: bells, arrived: make(chan struct{})}
+	if server {
+		c.in, c.out = toServer, toClient
+	}
+
+	return c
+}
+
+// watch - started once both ends have switched to shared memory. Only descriptors are sent on the socket after that,
+// so reading from it fails once the other end has gone.
+func (c *shmConn) watch() {
+	b := make([]byte, 1)
+	for {
+		files, err := readFiles(c.Conn, b)
+		if err != nil {
+			break
+		}
+
+		c.fmu.Lock()
+		c.files = append(c.files, files...)
+		flooded := len(c.files) > maxPendingFiles
+		if flooded {
+			closeFiles(c.files)
+			c.files = nil
+		}
+		c.signalFiles()
+		c.fmu.Unlock()
+
+		if flooded {
+			// far more descriptors than the messages sent with them can take, the other end is misbehaving
+			c.Conn.Close()
+			break
+		}
+	}
+
+	c.fmu.Lock()
+	c.peerGone.Store(true)
+	c.signalFiles()
+	c.fmu.Unlock()
+
+	// wakes this end's reader and writer
+	c.use(func() int {
+		ringBell(c.in.dataBell)
+		ringBell(c.out.spaceBell)
+		return 0
+	})
+}
+
+// signalFiles - wakes takeFiles, must be called with fmu held
+func (c *shmConn) signalFiles() {
+	close(c.arrived)
+	c.arrived = make(chan struct{})
+}
+
+// takeFiles - the next n descriptors received on the socket, waits for them as they're sent separately from the frame
+func (c *shmConn) takeFiles(n int) ([]*os.File, error) {
+	for {
+		c.fmu.Lock()
+		if len(c.files) >= n {
+			files := c.files[:n:n]
+			c.files = c.files[n:]
+			c.fmu.Unlock()
+
+			return files, nil
+		}
+
+		gone := c.peerGone.Load()
+		arrived := c.arrived
+		c.fmu.Unlock()
+
+		if gone {
+			return nil, errors.New("the connection closed before the descriptors sent with the message arrived")
+		}
+
+		<-arrived
+	}
+}
+
+// use - runs f while the rings are mapped
+func (c *shmConn) use(f func() int) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.released {
+		return 0, net.ErrClosed
+	}
+
+	return f(), nil
+}
+
+// Read - reads what has been written to the ring from the other end, blocks while it's empty
+func (c *shmConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		gone := c.peerGone.Load() // anything it wrote before it went is still read
+		n, err := c.use(func() int {
+			n := c.in.read(p)
+			if n == 0 {
+				c.in.readerWaiting.Store(1)
+				n = c.in.read(p) // in case it was written before the producer could see the flag
+			}
+			return n
+		})
+		if n > 0 || err != nil {
+			return n, err
+		}
+
+		if gone {
+			return 0, io.EOF
+		}
+
+		err = waitBell(c.in.dataBell)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write - writes p to the ring to the other end, blocks while it's full
+func (c *shmConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if c.peerGone.Load() {
+			return written, io.ErrClosedPipe
+		}
+
+		n, err := c.use(func() int {
+			n := c.out.write(p[written:])
+			if n == 0 {
+				c.out.writerWaiting.Store(1)
+				n = c.out.write(p[written:]) // in case it was read before the consumer could see the flag
+			}
+			return n
+		})
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		if n == 0 {
+			err = waitBell(c.out.spaceBell)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close - closes the socket and unmaps the rings
+func (c *shmConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+
+	return err
+}
+
+// release - unmaps the rings and closes the eventfds, anything waiting on them returns an error
+func (c *shmConn) release() {
+	for _, b := range c.bells {
+		b.Close()
+	}
+
+	c.fmu.Lock()
+	closeFiles(c.files)
+	c.files = nil
+	c.fmu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.released {
+		c.released = true
+		unmapShm(c.mem)
+	}
+}
+
+// SetDeadline - sets the read and write deadlines
+func (c *shmConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline - Read returns os.ErrDeadlineExceeded if it's still waiting for data at t
+func (c *shmConn) SetReadDeadline(t time.Time) error {
+	return c.in.dataBell.SetReadDeadline(t)
+}
+
+// SetWriteDeadline - Write returns os.ErrDeadlineExceeded if it's still waiting for space at t
+func (c *shmConn) SetWriteDeadline(t time.Time) error {
+	return c.out.spaceBell.SetReadDeadline(t)
+}
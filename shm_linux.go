@@ -0,0 +1,198 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func shmSupported() bool {
+	return true
+}
+
+// offerShm - sends the shared memory to the client, returns nil if the connection carries on over the socket
+func offerShm(conn net.Conn, enc *encryption, size int) (net.Conn, error) {
+	uc, ok := conn.(*net.UnixConn)
+
+	var fds []int
+	var mem []byte
+	var err error
+	if ok {
+		fds, mem, err = makeShm(size)
+	}
+
+	if !ok || err != nil {
+		return nil, writeSealed(conn, enc, []byte{0})
+	}
+
+	defer unix.Close(fds[0]) // the mapping is kept once the memfd has been sent
+	sc := newShmConn(conn, mem, files(fds[1:]), true)
+
+	msg := sealedFrame(enc, binary.BigEndian.AppendUint32([]byte{1}, uint32(size)))
+	_, _, err = uc.WriteMsgUnix(msg, unix.UnixRights(fds...), nil)
+	if err != nil {
+		sc.release()
+		return nil, errors.New("unable to send the shared memory")
+	}
+
+	reply, err := readSealed(conn, enc, 1)
+	if err != nil || len(reply) != 1 {
+		sc.release()
+		return nil, errors.New("did not receive the shared memory reply")
+	}
+
+	if reply[0] != 0 {
+		sc.release()
+		return nil, nil
+	}
+
+	go sc.watch()
+
+	return sc, nil
+}
+
+// acceptShm - maps the shared memory sent by the server, returns nil if the connection carries on over the socket
+func acceptShm(conn net.Conn, enc *encryption) (net.Conn, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("shared memory needs a unix socket")
+	}
+
+	// only the length first, if the server isn't sending shared memory the frames follow straight after the message
+	length := make([]byte, 4)
+	oob := make([]byte, unix.CmsgSpace(5*4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(length, oob)
+	if err == nil {
+		_, err = io.ReadFull(conn, length[n:])
+	}
+	if err != nil {
+		return nil, errors.New("did not receive the shared memory")
+	}
+
+	var fds []int
+	cmsgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+	for _, cm := range cmsgs {
+		f, err := unix.ParseUnixRights(&cm)
+		if err == nil {
+			fds = append(fds, f...)
+		}
+	}
+
+	msg, err := readSealedRest(conn, enc, length, 5)
+	if err != nil || len(msg) == 0 {
+		closeFds(fds)
+		return nil, errors.New("did not receive the shared memory")
+	}
+
+	if msg[0] == 0 || len(msg) != 5 {
+		closeFds(fds)
+		return nil, nil
+	}
+
+	var mem []byte
+	size := int(binary.BigEndian.Uint32(msg[1:]))
+	if len(fds) == 5 && size > 0 && size <= maxShmSize {
+		mem, err = mapShm(fds[0], size, false)
+	}
+
+	if mem == nil || err != nil {
+		closeFds(fds)
+		return nil, writeSealed(conn, enc, []byte{1})
+	}
+
+	unix.Close(fds[0])
+	sc := newShmConn(conn, mem, files(fds[1:]), false)
+
+	err = writeSealed(conn, enc, []byte{0})
+	if err != nil {
+		sc.release()
+		return nil, errors.New("unable to send the shared memory reply")
+	}
+
+	go sc.watch()
+
+	return sc, nil
+}
+
+// makeShm - creates the memfd for two rings of size bytes and the eventfds for them
+func makeShm(size int) ([]int, []byte, error) {
+	memfd, err := unix.MemfdCreate("golang-ipc", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fds := []int{memfd}
+	mem, err := mapShm(memfd, size, true)
+	if err != nil {
+		closeFds(fds)
+		return nil, nil, err
+	}
+
+	for range 4 {
+		fd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+		if err != nil {
+			closeFds(fds)
+			unix.Munmap(mem)
+			return nil, nil, err
+		}
+
+		fds = append(fds, fd)
+	}
+
+	return fds, mem, nil
+}
+
+// mapShm - maps the memfd of two rings of size bytes. The server seals its size first, the client checks it has been
+// sealed as the mapping would fault if the other end could shrink it.
+func mapShm(fd, size int, create bool) ([]byte, error) {
+	total := 2 * (shmHeaderSize + size)
+
+	if create {
+		err := unix.Ftruncate(fd, int64(total))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_SEAL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		seals, err := unix.FcntlInt(uintptr(fd), unix.F_GET_SEALS, 0)
+		if err != nil || seals&unix.F_SEAL_SHRINK == 0 {
+			return nil, errors.New("the shared memory hasn't been sealed")
+		}
+
+		var st unix.Stat_t
+		err = unix.Fstat(fd, &st)
+		if err != nil || st.Size != int64(total) {
+			return nil, errors.New("the shared memory is the wrong size")
+		}
+	}
+
+	return unix.Mmap(fd, 0, total, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func unmapShm(mem []byte) {
+	unix.Munmap(mem)
+}
+
+// files - the eventfds as files, they are non-blocking so waiting on them doesn't tie up a thread
+func files(fds []int) []*os.File {
+	f := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		f[i] = os.NewFile(uintptr(fd), "eventfd")
+	}
+
+	return f
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
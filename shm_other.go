@@ -0,0 +1,22 @@
+//go:build !linux
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+func shmSupported() bool {
+	return false
+}
+
+func offerShm(conn net.Conn, enc *encryption, size int) (net.Conn, error) {
+	return nil, errors.New("shared memory is only supported on linux")
+}
+
+func acceptShm(conn net.Conn, enc *encryption) (net.Conn, error) {
+	return nil, errors.New("shared memory is only supported on linux")
+}
+
+func unmapShm(mem []byte) {}
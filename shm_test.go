@@ -0,0 +1,155 @@
+//go:build linux
+
+package ipc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestShmEncrypted(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{SharedMemory: true, Encryption: true}, &ClientConfig{SharedMemory: true, Encryption: true})
+
+	if !c.NegotiatedFeatures().Has(FeatureShm) || !s.Sessions()[0].NegotiatedFeatures().Has(FeatureShm) {
+		t.Fatal("shared memory wasn't agreed on")
+	}
+	if _, ok := c.conn.(*shmConn); !ok {
+		t.Fatal("the client isn't using shared memory")
+	}
+
+	for i := range 10 {
+		exchange(t, c.Write, sr, fmt.Sprint("to server ", i))
+		exchange(t, s.Write, cr, fmt.Sprint("to client ", i))
+	}
+}
+
+// when only one end asks for shared memory the connection stays on the socket
+func TestShmOneSided(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		server, client bool
+	}{
+		{"server", true, false},
+		{"client", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{SharedMemory: tc.server}, &ClientConfig{SharedMemory: tc.client})
+
+			if c.NegotiatedFeatures().Has(FeatureShm) {
+				t.Fatal("shared memory was agreed on")
+			}
+			if _, ok := c.conn.(*shmConn); ok {
+				t.Fatal("the client is using shared memory")
+			}
+
+			exchange(t, c.Write, sr, "to server")
+			exchange(t, s.Write, cr, "to client")
+		})
+	}
+}
+
+// a client that can't map the shared memory it's sent tells the server and both carry on over the socket
+func TestShmFallback(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprint("encrypted=", encrypted), func(t *testing.T) {
+			fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, client := unixConn(t, fds[0]), unixConn(t, fds[1])
+
+			var senc, cenc *encryption
+			if encrypted {
+				secret := make([]byte, 32)
+				senc, _ = newEncryption(X25519, AES256GCM, secret, nil, nil, dirServer)
+				cenc, _ = newEncryption(X25519, AES256GCM, secret, nil, nil, dirClient)
+			}
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			offered := make(chan result, 1)
+			go func() {
+				conn, err := offerShm(server, senc, maxShmSize+1) // more than the client will map
+				if err == nil && conn == nil {
+					_, err = server.Write([]byte("socket"))
+				}
+				offered <- result{conn, err}
+			}()
+
+			conn, err := acceptShm(client, cenc)
+			if err != nil || conn != nil {
+				t.Fatalf("client accepted the shared memory: %v", err)
+			}
+
+			r := <-offered
+			if r.err != nil || r.conn != nil {
+				t.Fatalf("server moved to the shared memory: %v", r.err)
+			}
+
+			b := make([]byte, 6)
+			_, err = io.ReadFull(client, b)
+			if err != nil || string(b) != "socket" {
+				t.Fatalf("received %q after the fallback: %v", b, err)
+			}
+		})
+	}
+}
+
+func unixConn(t *testing.T, fd int) net.Conn {
+	f := os.NewFile(uintptr(fd), "socketpair")
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// descriptors sent without the messages that take them fail the connection once too many are waiting, and are closed
+func TestShmFilesFlood(t *testing.T) {
+	s, _, _, cr := start(t, &ServerConfig{MultiClient: true, SharedMemory: true}, &ClientConfig{SharedMemory: true, DisableReconnect: true})
+	ssc, ok := s.Sessions()[0].conn.(*shmConn)
+	if !ok {
+		t.Fatal("the server isn't using shared memory")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	open := func() int {
+		fds, _ := os.ReadDir("/proc/self/fd")
+		return len(fds)
+	}
+	before := open()
+
+	files := make([]*os.File, maxFiles)
+	for i := range files {
+		files[i] = r
+	}
+	for range maxPendingFiles/maxFiles + 1 {
+		err := sendRights(ssc.Conn, []byte{0}, files)
+		if err != nil {
+			break
+		}
+	}
+
+	waitFor(t, cr, isStatus(Disconnected))
+
+	if after := open(); after > before {
+		t.Fatalf("%d descriptors were left open", after-before)
+	}
+}
@@ -0,0 +1,157 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+)
+
+var errShuttingDown = errors.New("connection is shutting down")
+
+// Shutdown - closes the connection gracefully. New writes are refused, the messages already queued are sent followed by a go away
+// so the server doesn't wait for the client to reconnect, and any calls or router handlers that are still running are waited for.
+// If ctx is done before all of that has happened the connection is closed straight away and ctx.Err() is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	var err error
+	if c.status.get() == Connected {
+		// anything still in the outbox goes out ahead of the go away
+		c.draining.Store(true)
+		c.flushOutbox()
+
+		err = c.drain(ctx)
+	}
+
+	c.Close()
+
+	return err
+}
+
+// Shutdown - closes the connection to this client gracefully, see Client.Shutdown
+func (ss *Session) Shutdown(ctx context.Context) error {
+	var err error
+	if ss.status.get() == Connected {
+		err = ss.drain(ctx)
+	}
+
+	ss.Close()
+
+	return err
+}
+
+// Shutdown - stops accepting new clients and shuts down every session gracefully, see Client.Shutdown.
+// Router handlers started by Serve are also waited for before the server is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.status.get() == Closing {
+		return nil
+	}
+
+	if s.listen != nil {
+		s.listen.Close()
+	}
+
+	sessions := s.Sessions()
+	errs := make(chan error, len(sessions))
+	for _, ss := range sessions {
+		go func() {
+			if ss.status.get() != Connected {
+				errs <- nil
+				return
+			}
+
+			errs <- ss.drain(ctx)
+		}()
+	}
+
+	var err error
+	for range sessions {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		err = s.running.wait(ctx)
+	}
+
+	s.Close()
+
+	return err
+}
+
+// drain - sends a go away after everything already queued, then waits for the calls being handled and sends their replies
+func (l *link) drain(ctx context.Context) error {
+	l.draining.Store(true)
+
+	err := l.flush(ctx, &Message{MsgType: 0, Data: []byte{controlGoAway}})
+	if err != nil {
+		return err
+	}
+
+	err = l.running.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return l.flush(ctx)
+}
+
+// flush - queues the messages and waits until the writer has sent them along with everything queued before them
+func (l *link) flush(ctx context.Context, msgs ...*Message) error {
+	flushed := make(chan struct{})
+
+	for _, m := range append(msgs, &Message{flushed: flushed}) {
+		select {
+		case l.sent <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.done:
+			return errors.New("the connection has been closed")
+		}
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.done:
+		return errors.New("the connection has been closed")
+	}
+}
+
+func (r *running) add() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.n == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.n++
+}
+
+func (r *running) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.n--
+	if r.n == 0 {
+		close(r.idle)
+	}
+}
+
+// wait - blocks until nothing is running or ctx is done
+func (r *running) wait(ctx context.Context) error {
+	r.mu.Lock()
+	if r.n == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,484 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// OpenStream - opens a stream to the server, the server receives a message of msgType with Stream set to read the data from.
+// Data written to the stream is split into frames automatically and writes block while the server hasn't read enough of what
+// has already been sent. Close must be called once all of the data has been written.
+func (c *Client) OpenStream(msgType int) (io.WriteCloser, error) {
+	err := c.checkWrite(msgType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.openStream(msgType)
+}
+
+// OpenStream - opens a stream to the client connected to the session, see Client.OpenStream
+func (ss *Session) OpenStream(msgType int) (io.WriteCloser, error) {
+	err := ss.checkWrite(msgType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.openStream(msgType)
+}
+
+// OpenStream - opens a stream to the connected client, see Client.OpenStream
+//
+// In MultiClient mode use Session.OpenStream instead.
+func (s *Server) OpenStream(msgType int) (io.WriteCloser, error) {
+	if s.conf.MultiClient {
+		return nil, errors.New("server is in multi client mode, use Session.OpenStream instead")
+	}
+
+	ss := s.current()
+	if ss == nil {
+		return nil, errors.New(s.status.String())
+	}
+
+	return ss.OpenStream(msgType)
+}
+
+func (l *link) openStream(msgType int) (*stream, error) {
+	if l.draining.Load() {
+		return nil, errShuttingDown
+	}
+
+	if !l.hasFeature(FeatureMux) {
+		return nil, errors.New("the other end doesn't support streams and channels")
+	}
+
+	l.mu.Lock()
+	l.streamID += 2
+	st := l.newStream(l.streamID, msgType)
+	l.mu.Unlock()
+
+	err := l.queueFrame(&Message{MsgType: msgType, flags: flagStream | flagStreamOpen, streamID: st.id})
+	if err != nil {
+		l.removeStream(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// newStream - must be called with l.mu held
+func (l *link) newStream(id uint32, msgType int) *stream {
+	if l.streams == nil {
+		l.streams = make(map[uint32]*stream)
+	}
+
+	st := &stream{
+		l:          l,
+		id:         id,
+		msgType:    msgType,
+		credit:     streamWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+	l.streams[id] = st
+
+	return st
+}
+
+func (l *link) stream(id uint32) *stream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.streams[id]
+}
+
+func (l *link) removeStream(id uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.streams, id)
+}
+
+// streamFrame - handles a frame sent to a stream.
+// returns the message to deliver when the frame opens a new stream, nil otherwise
+// streams opened with message type 0 are channels and are passed to AcceptChannel instead.
+func (l *link) streamFrame(m *Message) *Message {
+	if m.flags&flagStreamOpen != 0 {
+		l.mu.Lock()
+		st := l.newStream(m.streamID, m.MsgType)
+		l.mu.Unlock()
+
+		if m.MsgType == 0 {
+			l.acceptStream(st)
+		} else {
+			m.Stream = st
+		}
+	}
+
+	st := l.stream(m.streamID)
+	if st == nil {
+		return nil // already closed at this end
+	}
+
+	if len(m.Data) > 0 || m.flags&flagStreamClose != 0 {
+		st.received(m.Data, m.flags&flagStreamClose != 0)
+	}
+
+	if m.flags&flagStreamOpen != 0 && m.MsgType != 0 {
+		return m
+	}
+
+	return nil
+}
+
+// failStreams - ends every open stream when the connection has been lost
+func (l *link) failStreams(err error) {
+	l.mu.Lock()
+	streams := l.streams
+	l.streams = nil
+	l.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// queue - queues a message to be sent, fails if the connection has been closed
+func (l *link) queue(m *Message) error {
+	select {
+	case l.sent <- m:
+		return nil
+	case <-l.done:
+		return errors.New("the connection has been closed")
+	}
+}
+
+// queueFrame - queues a frame of a stream or channel. They wait behind the messages in sent, so a busy stream doesn't
+// hold up messages, calls and control messages, which are small and may be what the other end is waiting for.
+func (l *link) queueFrame(m *Message) error {
+	select {
+	case l.frames <- m:
+		return nil
+	case <-l.done:
+		return errors.New("the connection has been closed")
+	}
+}
+
+// next - the next message for the writer to send, messages go before the frames of streams and channels.
+// returns false once the connection has been closed
+func (l *link) next() (*Message, bool) {
+	select {
+	case m, ok := <-l.sent:
+		return m, ok
+	default:
+	}
+
+	select {
+	case m, ok := <-l.sent:
+		return m, ok
+	case m := <-l.frames:
+		return m, true
+	case <-l.done:
+		return nil, false
+	}
+}
+
+// writeFrames - sends the frames that are waiting, so a flush covers the streams as well
+func (l *link) writeFrames() {
+	for {
+		select {
+		case m := <-l.frames:
+			err := l.writeMsg(m)
+			if err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Read - reads the data sent to the stream, returns io.EOF once the sender has closed it and all of the data has been read
+func (st *stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+
+		if st.buff.Len() > 0 {
+			n, _ := st.buff.Read(p)
+
+			// give the sender more credit once half of the window has been read
+			credit := 0
+			st.unacked += n
+			if st.unacked >= streamWindow/2 && !st.eof {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+
+			if credit > 0 {
+				data := binary.BigEndian.AppendUint32(nil, st.id)
+				data = binary.BigEndian.AppendUint32(data, uint32(credit))
+				st.l.sendControl(controlCredit, data)
+			}
+
+			return n, nil
+		}
+
+		err := st.readErr()
+		deadline := st.rDeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+
+		err = wait(st.readReady, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readErr - the error to return from Read once all the received data has been read, must be called with st.mu held
+func (st *stream) readErr() error {
+	switch {
+	case st.eof:
+		return io.EOF
+	case st.closed:
+		return io.ErrClosedPipe
+	}
+
+	return st.err
+}
+
+// Write - sends p to the other end, blocking while the other end has no more room for it
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n, err := st.reserve(len(p))
+		if err != nil {
+			return written, err
+		}
+
+		m := &Message{MsgType: st.msgType, Data: append([]byte(nil), p[:n]...), flags: flagStream, streamID: st.id}
+		err = st.l.queueFrame(m)
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// reserve - waits until there is credit to send data and returns how much of it can go in the next frame
+func (st *stream) reserve(size int) (int, error) {
+	for {
+		st.mu.Lock()
+
+		err := st.writeErr()
+		if err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		if st.credit > 0 {
+			n := min(size, st.credit, streamChunkSize)
+			if st.l.maxSize > 0 {
+				n = min(n, st.l.maxSize)
+			}
+			st.credit -= n
+			st.mu.Unlock()
+
+			return n, nil
+		}
+
+		deadline := st.wDeadline
+		st.mu.Unlock()
+
+		err = wait(st.writeReady, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeErr - must be called with st.mu held
+func (st *stream) writeErr() error {
+	switch {
+	case st.closed || st.finished:
+		return io.ErrClosedPipe
+	case st.err != nil:
+		return st.err
+	case st.stopped:
+		return errors.New("the stream has been closed by the other end")
+	}
+
+	return nil
+}
+
+// Close - finishes writing to the stream and stops reading from it
+func (st *stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.closed = true
+	finished, eof, err := st.finished, st.eof, st.err
+	st.finished = true
+	st.buff.Reset()
+	st.mu.Unlock()
+
+	st.signal()
+	st.l.removeStream(st.id)
+
+	if err != nil {
+		return nil
+	}
+
+	if !finished {
+		err = st.l.queueFrame(&Message{MsgType: st.msgType, flags: flagStream | flagStreamClose, streamID: st.id})
+	}
+
+	if !eof {
+		st.l.sendControl(controlStopStream, binary.BigEndian.AppendUint32(nil, st.id))
+	}
+
+	return err
+}
+
+// closeWrite - tells the other end no more data will be sent
+func (st *stream) closeWrite() error {
+	st.mu.Lock()
+	err := st.writeErr()
+	st.finished = true
+	st.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return st.l.queueFrame(&Message{MsgType: st.msgType, flags: flagStream | flagStreamClose, streamID: st.id})
+}
+
+func (st *stream) received(data []byte, eof bool) {
+	st.mu.Lock()
+	if st.closed || st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+
+	if st.buff.Len()+len(data) > streamWindow {
+		st.mu.Unlock()
+		st.reset(errors.New("the other end has sent more data than the stream window"))
+		return
+	}
+
+	st.buff.Write(data)
+	st.eof = st.eof || eof
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+// reset - ends a stream the other end hasn't kept to the window of, the data waiting to be read is dropped and
+// the other end is told to stop sending
+func (st *stream) reset(err error) {
+	st.mu.Lock()
+	st.err = err
+	finished := st.finished
+	st.finished = true
+	st.buff.Reset()
+	st.mu.Unlock()
+
+	st.signal()
+	st.l.removeStream(st.id)
+
+	if !finished {
+		st.l.queueFrame(&Message{MsgType: st.msgType, flags: flagStream | flagStreamClose, streamID: st.id})
+	}
+	st.l.sendControl(controlStopStream, binary.BigEndian.AppendUint32(nil, st.id))
+}
+
+func (st *stream) addCredit(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+func (st *stream) stop() {
+	st.mu.Lock()
+	st.stopped = true
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+func (st *stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+// setDeadlines - sets the read and/or write deadline, a nil time leaves it unchanged
+func (st *stream) setDeadlines(r, w *time.Time) {
+	st.mu.Lock()
+	if r != nil {
+		st.rDeadline = *r
+	}
+	if w != nil {
+		st.wDeadline = *w
+	}
+	st.mu.Unlock()
+
+	st.signal()
+}
+
+// wait - waits for ready to be signalled, returns os.ErrDeadlineExceeded if the deadline passes first
+func wait(ready chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ready
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ready:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// signal - wakes up anything waiting to read from or write to the stream
+func (st *stream) signal() {
+	select {
+	case st.readReady <- struct{}{}:
+	default:
+	}
+
+	select {
+	case st.writeReady <- struct{}{}:
+	default:
+	}
+}
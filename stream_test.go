@@ -0,0 +1,155 @@
+package ipc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// sendStream - writes data to a new stream of message type 4 and closes it, returns the error from writing
+func sendStream(open func(int) (io.WriteCloser, error), data []byte) chan error {
+	errs := make(chan error, 1)
+
+	w, err := open(4)
+	if err != nil {
+		errs <- err
+		return errs
+	}
+
+	go func() {
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		errs <- err
+	}()
+
+	return errs
+}
+
+// data larger than the window is streamed both ways, with and without encryption
+func TestStream(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprint("encrypted=", encrypted), func(t *testing.T) {
+			s, sr, c, cr := start(t, &ServerConfig{Encryption: encrypted}, &ClientConfig{Encryption: encrypted})
+
+			for _, dir := range []struct {
+				open     func(int) (io.WriteCloser, error)
+				received chan *Message
+			}{
+				{c.OpenStream, sr},
+				{s.OpenStream, cr},
+			} {
+				data := bytes.Repeat([]byte("streamed "), streamWindow/3)
+				sent := sendStream(dir.open, data)
+
+				m := waitFor(t, dir.received, isMsg(4))
+				if m.Stream == nil {
+					t.Fatal("the message doesn't have a stream")
+				}
+
+				got, err := io.ReadAll(m.Stream)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m.Stream.Close()
+
+				if !bytes.Equal(got, data) {
+					t.Fatalf("received %d bytes that don't match the %d sent", len(got), len(data))
+				}
+				if err := <-sent; err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// the writer waits while the reader has a window of unread data, and carries on once it has been read
+func TestStreamFlowControl(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{}, &ClientConfig{})
+
+	data := make([]byte, 3*streamWindow)
+	sent := sendStream(c.OpenStream, data)
+
+	m := waitFor(t, sr, isMsg(4))
+	st := m.Stream.(*stream)
+
+	select {
+	case err := <-sent:
+		t.Fatalf("writing more than the window to a stream that isn't read returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	st.mu.Lock()
+	buffered := st.buff.Len()
+	st.mu.Unlock()
+	if buffered > streamWindow {
+		t.Fatalf("%d bytes were buffered", buffered)
+	}
+
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("received %d bytes, expected %d", len(got), len(data))
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	exchange(t, s.Write, cr, "after")
+}
+
+// a stream that is sent more than its window is reset, rather than buffering whatever the other end sends
+func TestStreamWindowExceeded(t *testing.T) {
+	s, sr, c, cr := start(t, &ServerConfig{}, &ClientConfig{})
+
+	w, err := c.OpenStream(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := w.(*stream).id
+
+	m := waitFor(t, sr, isMsg(4))
+
+	// frames sent without waiting for credit
+	for range streamWindow/streamChunkSize + 2 {
+		err := c.queueFrame(&Message{MsgType: 4, Data: make([]byte, streamChunkSize), flags: flagStream, streamID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// not read until the frames have arrived, so they go past the window
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Sessions()[0].stream(id) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream wasn't reset")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	n, err := m.Stream.Read(make([]byte, streamWindow))
+	if n != 0 || err == nil || err == io.EOF {
+		t.Fatalf("read %d bytes and %v from a stream that was reset", n, err)
+	}
+
+	// the sender is told to stop
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		_, err := w.Write([]byte("more"))
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sender wasn't stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	exchange(t, s.Write, cr, "still connected")
+}
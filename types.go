@@ -1,46 +1,325 @@
 package ipc
 
 import (
+	"bytes"
+	"context"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Server - holds the details of the server connection & config.
 type Server struct {
-	Name      string
-	listen    net.Listener
-	conn      net.Conn
-	status    Status
-	connected chan bool // ?
-	received  chan (*Message)
-	sent      chan (*Message)
-	enc       *encryption
-	conf      ServerConfig
+	Name     string
+	listen   net.Listener
+	status   state
+	received chan (*Message)
+	conf     ServerConfig
+	mu       sync.Mutex
+	sessions map[int]*Session
+	lastID   int
+	handlers *callHandlers
+	controls *controlHandlers
+	accept   chan *stream    // channels opened by clients waiting for AcceptChannel
+	ctx      context.Context // the context the server was started with
+	done     chan struct{}   // closed once the server has been closed
+	doneOnce sync.Once
+	notifyMu sync.RWMutex // held by notify so received isn't closed while a message is being passed to Read
+	running  running      // router handlers still running
+	rel      *reliable    // reliable delivery state of the client in single client mode, kept across its reconnects
+	relOwner *Session     // the last session to use rel
+	tickets  cipher.AEAD  // encrypts the session tickets given to clients
+	resume   map[int]*resumption
+}
+
+// resumption - what the server needs to carry on a session when its client presents a ticket
+type resumption struct {
+	id       int
+	secret   []byte // also known to the client, the key of a resumed connection is made from it
+	features []string
+	proto    int
+	comp     Compression
+	peerKey  ed25519.PublicKey
+	curve    Curve
+	suite    CipherSuite
+	rel      *reliable
+	owner    *Session    // the session that currently holds it
+	expiry   *time.Timer // forgets the session once it has been disconnected for ResumeTimeout
+}
+
+// Session - holds the details of a single client connected to the server.
+type Session struct {
+	ID       int // unique id of the session, also set as the ClientID of each message it receives
+	server   *Server
+	stopped  chan struct{} // closed once the session has stopped writing
+	resuming *resumption   // set by the handshake when the client has resumed an earlier session
+	peer     *PeerCred     // credentials of the client process, nil if they aren't available
+	link
+}
+
+// PeerCred - the process at the other end of a unix socket, as reported by the operating system
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
 }
 
 // Client - holds the details of the client connection and config.
 type Client struct {
-	Name     string
+	Name string
+	conf ClientConfig
+	ctx  context.Context // the context the client was started with
+	link
+	outbox *outbox // messages written while reconnecting (nil unless ClientConfig.Outbox is set)
+	auth   bool    // the server said during the handshake that it authenticates connections
+}
+
+// link - the connection details shared by the client and each server session
+type link struct {
 	conn     net.Conn
-	status   Status
+	status   state
 	received chan (*Message)
 	sent     chan (*Message)
+	frames   chan *Message // frames of streams and channels, only sent while nothing is waiting in sent
+	done     chan struct{} // closed once the connection has been closed
+	doneOnce sync.Once     // done can be closed both by Close and when the connection is lost
 	enc      *encryption
-	conf     ClientConfig
+	codec    Codec
+	handlers *callHandlers
+	mu       sync.Mutex
+	lastCall uint32
+	pending  map[uint32]chan *Message // calls waiting for a reply, keyed by call id
+	streams  map[uint32]*stream
+	streamID uint32       // id of the last stream opened at this end, clients use odd numbers and servers even
+	maxSize  int          // maximum size of a message that can be sent
+	accept   chan *stream // channels opened by the other end waiting for AcceptChannel
+	clientID int          // id of the session (server only)
+	name     string       // name of the socket or pipe
+	rtt      atomic.Int64 // round trip time measured by the last heartbeat
+	missed   atomic.Int32 // heartbeats sent since the last pong
+	controls *controlHandlers
+	peerCaps []string
+	leaving  atomic.Bool       // the other end has said it's closing the connection
+	wmu      sync.Mutex        // held while a frame is being written
+	draining atomic.Bool       // Shutdown has been called, no new writes are accepted
+	running  running           // calls being handled
+	features []string          // optional features both ends agreed on during the handshake
+	rel      *reliable         // nil unless reliable delivery is being used
+	resumed  bool              // the last handshake resumed an earlier session
+	ticket   []byte            // the ticket the server gave the client, presented when it reconnects (client only)
+	secret   []byte            // the secret that came with the ticket (client only)
+	peerKey  ed25519.PublicKey // identity key the other end proved it has, nil if it didn't send one
+	rekeyAt  RekeyConfig       // limits on the use of a key that start a rekey
+	proto    int               // protocol version agreed on during the handshake
+	comp     Compression       // compression agreed on during the handshake, 0 if there isn't any
+	compMin  int               // payloads smaller than this aren't compressed
+}
+
+// Channel - a bidirectional stream of data multiplexed over a connection, it implements net.Conn.
+// Each channel has its own flow control, so a channel that isn't being read doesn't hold up messages or other channels.
+type Channel struct {
+	st *stream
+}
+
+// Addr - the address of a channel, the name of the socket or pipe it was opened over
+type Addr string
+
+// listener - accepts the channels opened by clients as net.Conns, see Server.Listener
+type listener struct {
+	s      *Server
+	closed chan struct{}
+	once   sync.Once
+}
+
+// stream - one end of a stream of data sent over a connection in a series of frames.
+// The receiver gives the sender credit for the data it has read, so the sender can never have more than
+// streamWindow bytes waiting to be read.
+type stream struct {
+	l          *link
+	id         uint32
+	msgType    int
+	mu         sync.Mutex
+	buff       bytes.Buffer // data received but not read yet
+	unacked    int          // data read since the sender was last given credit
+	credit     int          // data that can be sent before the other end gives more credit
+	eof        bool         // the other end has finished writing
+	finished   bool         // this end has finished writing
+	stopped    bool         // the other end has stopped reading
+	closed     bool
+	err        error
+	rDeadline  time.Time
+	wDeadline  time.Time
+	readReady  chan struct{}
+	writeReady chan struct{}
 }
 
 // Message - contains the  received message
 type Message struct {
-	Err     error  // details of any error
-	MsgType int    // 0 = reserved , -1 is an internal message (disconnection or error etc), all messages recieved will be > 0
-	Data    []byte // message data received
-	Status  string // the status of the connection
+	Err       error         // details of any error
+	MsgType   int           // 0 = reserved , -1 is an internal message (disconnection or error etc), all messages recieved will be > 0
+	Data      []byte        // message data received
+	Status    string        // the status of the connection
+	ClientID  int           // id of the session the message came from (server only)
+	Stream    io.ReadCloser // set when the message opens a stream, the data sent to the stream is read from it
+	flags     uint16
+	callID    uint32
+	streamID  uint32
+	codec     Codec         // codec of the connection the message was received on
+	flushed   chan struct{} // closed by the writer when it reaches the message instead of sending it
+	seq       uint32        // sequence number (reliable delivery only)
+	Event     *Event        // set when MsgType is -3, something that happened to the connection
+	PeerCred  *PeerCred     // credentials of the client that sent the message (server only, nil if they aren't available)
+	Files     []*os.File    // descriptors sent with the message by WriteWithFDs, the receiver has to close them
+	fileCount uint32        // number of descriptors the frame says were sent with it
+}
+
+// Event - something that happened to the connection that isn't a change of status, received with a MsgType of -3
+type Event struct {
+	Type    EventType
+	Attempt int           // attempts to connect that have failed so far (EventRetry and EventGaveUp)
+	Delay   time.Duration // how long until the next attempt (EventRetry)
+	Err     error         // why the last attempt failed (nil if the server wasn't there), or the *ReplayError of an EventReplay
+}
+
+// EventType - the kind of Event
+type EventType int
+
+const (
+	// EventRetry - an attempt to connect has failed and the client will try again after Delay
+	EventRetry EventType = iota + 1
+	// EventGaveUp - the reconnect policy has stopped the client trying to connect, the client is closed
+	EventGaveUp
+	// EventReplay - an encrypted frame was dropped because it was replayed, reordered or reflected, Err is a *ReplayError
+	EventReplay
+	// EventRekey - the connection has switched to a new encryption key
+	EventRekey
+)
+
+// optional features the two ends of a connection can agree on during the handshake
+const (
+	FeatureReliable  = "reliable"  // reliable delivery, see ServerConfig.Reliable
+	FeatureMux       = "mux"       // streams and channels
+	FeatureHeartbeat = "heartbeat" // heartbeat pings are answered
+	FeatureCompress  = "compress"  // payloads are compressed, see ServerConfig.Compression
+	FeatureShm       = "shm"       // frames go through shared memory instead of the socket, see ServerConfig.SharedMemory
+	FeatureFiles     = "files"     // descriptors can be sent with WriteWithFDs
+)
+
+// Features - the protocol version and optional features both ends of a connection agreed on during the handshake
+type Features struct {
+	Version     int
+	Names       []string
+	Compression Compression // 0 if payloads aren't compressed
+}
+
+// Codec - encodes and decodes message payloads for Send and Decode.
+// The name is exchanged during the handshake and both ends of a connection must use the same one.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Sender - a connection values can be written to with Send (Client, Server or Session)
+type Sender interface {
+	Write(msgType int, message []byte) error
+	Codec() Codec
+}
+
+// CallHandler - handles the calls made to a message type with Call.
+// The returned data is sent back as the reply, or if an error is returned the caller receives it as a *RemoteError.
+type CallHandler func(ctx context.Context, m *Message) ([]byte, error)
+
+// HandlerFunc - handles the messages passed to it by a Router
+type HandlerFunc func(ctx context.Context, m *Message)
+
+// Router - passes each received message to the handler registered for its message type, as an alternative to calling Read in a loop.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[int]HandlerFunc
+	fallback HandlerFunc
+	onStatus func(clientID int, status Status)
+	onError  func(clientID int, err error)
+	onEvent  func(clientID int, e *Event)
+	sem      chan struct{} // limits the number of handlers running at once
+	wg       sync.WaitGroup
+}
+
+// running - counts the handlers that are still running so Shutdown can wait for them
+type running struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops back to 0
+}
+
+// reliable - sequence numbers of the messages sent and received with reliable delivery, kept across reconnects
+type reliable struct {
+	mu       sync.Mutex
+	sent     uint32     // sequence number given to the last message sent
+	unacked  []*Message // messages sent that the other end hasn't acknowledged, in order
+	received uint32     // sequence number of the last message received
+	epoch    uint64     // random id of this state, a new one means the numbering has started again
+	peer     uint64     // epoch of the other end's state the received numbers belong to
+	ackTimer *time.Timer
+	resumed  bool          // the other end has said where to carry on from on this connection
+	ready    chan struct{} // closed once resumed
+	space    chan struct{} // closed and replaced when acks make room for more messages
+}
+
+// ControlHandler - handles the application control messages sent with SendControl, Data holds everything after the opcode
+type ControlHandler func(m *Message)
+
+// controlHandlers - the control handlers registered with a Client or Server
+type controlHandlers struct {
+	mu sync.RWMutex
+	m  map[byte]ControlHandler
+}
+
+// RemoteError - the error returned by Call when the handler at the other end returned an error
+type RemoteError struct {
+	MsgType int
+	Msg     string
+}
+
+// AuthError - returned when a connection fails because one end couldn't authenticate the other, or refused it
+type AuthError struct {
+	Reason string
+	Err    error // the underlying error if there is one, such as the one returned by ServerConfig.Authorize
+}
+
+// callHandlers - the call handlers registered with a Client or Server
+type callHandlers struct {
+	mu sync.RWMutex
+	m  map[int]CallHandler
+}
+
+// BroadcastError - returned by Broadcast when the message could not be sent to one or more clients
+type BroadcastError struct {
+	Errs map[int]error // the error for each client, keyed by ClientID
+}
+
+// SendError - returned by the server's Read when a message that had been queued for a client couldn't be sent to it,
+// the client's session is disconnected
+type SendError struct {
+	ClientID int
+	MsgType  int
+	Err      error
 }
 
 // Status - Status of the connection
 type Status int
 
+// state - a Status read and changed by the goroutines of a connection and its caller
+type state struct {
+	v atomic.Int32
+}
+
 const (
 	// NotConnected - 0
 	NotConnected Status = iota
@@ -62,6 +341,8 @@ const (
 	Timeout
 	// Disconnected - 9
 	Disconnected
+	// Resumed - 10, reported instead of Connected when a client reconnects to the session it had before, the status is Connected from then on
+	Resumed
 )
 
 // ServerConfig - used to pass configuration overrides to ServerStart()
@@ -71,20 +352,185 @@ type ServerConfig struct {
 	MaxMsgSize        int
 	Encryption        bool
 	UnmaskPermissions bool
+	MultiClient       bool                       // accept any number of clients, each one gets its own Session
+	Codec             Codec                      // codec used by Send and Decode, clients must use the same one (default is JSONCodec)
+	Heartbeat         time.Duration              // how often to ping each client, 0 turns heartbeats off (default is off)
+	HeartbeatMisses   int                        // pings a client can miss before its session is disconnected (default is 3)
+	Reliable          bool                       // offer reliable delivery to clients, used with the ones that also turn it on
+	ResumeTimeout     time.Duration              // how long a client that has lost its connection can resume its session, 0 turns resumption off (default is off)
+	Authorize         func(cred *PeerCred) error // called with the credentials of each client before the handshake, returning an error refuses it
+	AllowUIDs         []int                      // only accept clients running as one of these users, empty accepts any user
+	AllowGIDs         []int                      // only accept clients whose primary group is one of these (supplementary groups aren't checked), empty accepts any group
+	PSK               []byte                     // pre-shared key mixed into the encryption key, clients must have the same one (needs Encryption)
+	Identity          ed25519.PrivateKey         // identity key the server proves itself to clients with (needs Encryption)
+	ClientKeys        []ed25519.PublicKey        // only accept clients with one of these identity keys, empty accepts any client
+	CipherSuites      []CipherSuite              // cipher suites offered to clients in order of preference (default is AES256GCM, ChaCha20Poly1305)
+	Curves            []Curve                    // key exchange curves offered to clients in order of preference (default is X25519, P256)
+	Rekey             RekeyConfig                // when to replace the encryption key of each connection (default is never)
+	Compression       []Compression              // compression offered to clients in order of preference (default is none)
+	CompressMin       int                        // payloads smaller than this aren't compressed (default is 512 bytes)
+	SharedMemory      bool                       // send frames through shared memory when the client asks for it too (linux only)
+	SharedMemorySize  int                        // bytes of shared memory for each direction (default is 4Mb)
 }
 
 // ClientConfig - used to pass configuration overrides to ClientStart()
 type ClientConfig struct {
-	SocketBasePath string
-	Timeout        time.Duration
-	RetryTimer     time.Duration
-	MaxMsgSize     int
-	Encryption     bool
+	SocketBasePath   string
+	Timeout          time.Duration
+	RetryTimer       time.Duration
+	MaxMsgSize       int
+	Encryption       bool
+	Codec            Codec               // codec used by Send and Decode, must match the server's (default is JSONCodec)
+	Codecs           []Codec             // other codecs the client can use if the server isn't using Codec
+	Heartbeat        time.Duration       // how often to ping the server, 0 turns heartbeats off (default is off)
+	HeartbeatMisses  int                 // pings the server can miss before the client reconnects (default is 3)
+	Outbox           *OutboxConfig       // queue messages written while the client is reconnecting, nil returns an error from Write instead (default is nil)
+	Reliable         bool                // use reliable delivery if the server offers it
+	Reconnect        ReconnectPolicy     // how long to wait between attempts to connect (default is ConstantBackoff of RetryTimer)
+	DisableReconnect bool                // don't reconnect when the connection is lost, the status changes to Disconnected instead
+	PSK              []byte              // pre-shared key mixed into the encryption key, must be the same as the server's
+	Identity         ed25519.PrivateKey  // identity key the client proves itself to the server with, only sent to a server that authenticates (has a PSK, Identity or ClientKeys)
+	ServerKeys       []ed25519.PublicKey // only connect to a server with one of these identity keys, empty accepts any server
+	CipherSuites     []CipherSuite       // cipher suites the client will use (default is AES256GCM, ChaCha20Poly1305)
+	Curves           []Curve             // key exchange curves the client will use (default is X25519, P256)
+	Rekey            RekeyConfig         // when to replace the encryption key (default is never)
+	Compression      []Compression       // compression the client will use if the server offers it (default is none)
+	CompressMin      int                 // payloads smaller than this aren't compressed (default is 512 bytes)
+	SharedMemory     bool                // send frames through shared memory if the server offers it (linux only)
+}
+
+// ReconnectPolicy - decides how long the client waits before each attempt to connect.
+// attempt is the number of attempts that have failed so far, returning false stops the client trying.
+type ReconnectPolicy interface {
+	Next(attempt int) (time.Duration, bool)
+}
+
+// ConstantBackoff - waits the same time before every attempt
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// ExponentialBackoff - waits longer after each failed attempt
+type ExponentialBackoff struct {
+	Initial    time.Duration // wait after the 1st failed attempt (default is 100ms)
+	Max        time.Duration // longest wait (default is 30s)
+	Multiplier float64       // how much longer each wait is than the last (default is 2)
+	Jitter     float64       // fraction of each wait that's random, from 0 to 1, so clients don't all reconnect at once
+}
+
+// MaxAttempts - gives up once Attempts attempts have failed, waiting as long as Policy says between them
+type MaxAttempts struct {
+	Attempts int
+	Policy   ReconnectPolicy // default is ConstantBackoff of ClientConfig.RetryTimer
+}
+
+// OutboxConfig - settings of the outbox that holds the messages written while the client is reconnecting
+type OutboxConfig struct {
+	Size     int            // maximum number of messages held (default is 1024)
+	Overflow OverflowPolicy // what happens to a message written when the outbox is full (default is OutboxDropOldest)
+	TTL      time.Duration  // messages older than this are dropped instead of being sent, 0 keeps them until they're sent
+	Path     string         // file the outbox is kept in, so it survives the client being restarted, empty keeps it in memory
+}
+
+// OverflowPolicy - what an outbox does with a message written when it's full
+type OverflowPolicy int
+
+const (
+	// OutboxDropOldest - the oldest message is dropped to make room
+	OutboxDropOldest OverflowPolicy = iota
+	// OutboxDropNewest - the message being written is dropped and Write returns an error
+	OutboxDropNewest
+	// OutboxBlock - Write waits until there is room, the context passed to WriteContext is done or the client is closed
+	OutboxBlock
+)
+
+// outbox - messages waiting for the client to reconnect, in the order they were written
+type outbox struct {
+	conf    OutboxConfig
+	mu      sync.Mutex
+	msgs    []outboxMsg
+	changed chan struct{} // closed and replaced whenever a message is removed
+	file    *os.File      // log of the messages added and removed, see outbox.go
+	logged  int           // messages in the file, including the ones removed since it was last compacted
+	removed int           // messages removed that haven't been logged yet
+	flushMu sync.Mutex    // held while the outbox is being sent, so two flushes don't interleave
+}
+
+type outboxMsg struct {
+	msgType int
+	data    []byte
+	expires time.Time // zero if the message never expires
 }
 
 // Encryption - encryption settings
 type encryption struct {
-	keyExchange string
-	encryption  string
-	cipher      *cipher.AEAD
+	curve  Curve       // curve of the key exchange, kept by connections that resume the session
+	suite  CipherSuite // cipher suite the connection is encrypted with
+	sealer cipher.AEAD // key frames are sent with, only changed while wmu is held
+	opener cipher.AEAD // key frames are read with, only changed by the reader
+	dir    byte        // direction of the frames sent by this end, dirClient or dirServer
+	sent   uint64      // sequence number of the next frame sent, only changed while wmu is held
+	recv   uint64      // sequence number of the next frame expected, only changed by the reader
+	legacy bool        // version 2 framing: a random nonce with each frame and no sequence numbers
+
+	frames   atomic.Int64 // frames sent and received with the current key
+	bytes    atomic.Int64 // bytes sent and received with the current key
+	keyed    atomic.Int64 // when the current key was made (unix nanoseconds)
+	mu       sync.Mutex
+	rekeying bool             // a rekey has been asked for and hasn't finished
+	priv     *ecdh.PrivateKey // this end's key for the rekey it asked for
+	next     cipher.AEAD      // key the other end will send with once it has switched (reader only)
 }
+
+// RekeyConfig - when the encryption key of a connection is replaced with a new one, whichever limit is reached first.
+// Zero turns a limit off, either end can start a rekey.
+type RekeyConfig struct {
+	Messages int           // frames sent and received with a key
+	Bytes    int           // bytes sent and received with a key
+	Interval time.Duration // age of a key, checked when a frame is sent or received
+}
+
+// ReplayError - why an encrypted frame was rejected, it had already been received, arrived out of order or was sent
+// by this end and reflected back to it. Received as the Err of an EventReplay.
+type ReplayError struct {
+	Seq       uint64 // sequence number of the frame
+	Expected  uint64 // sequence number of the next frame expected
+	Reflected bool
+}
+
+// CipherSuite - an AEAD the connection can be encrypted with, the client and server use the first one in the server's
+// list that they both support
+type CipherSuite uint8
+
+const (
+	// AES256GCM - AES-256 in GCM mode, the fastest where the CPU has AES instructions
+	AES256GCM CipherSuite = iota + 1
+	// ChaCha20Poly1305 - ChaCha20-Poly1305, faster than AES-GCM without AES instructions
+	ChaCha20Poly1305
+)
+
+// Curve - an elliptic curve the key exchange can use, the client and server use the first one in the server's list
+// that they both support
+type Curve uint8
+
+const (
+	// X25519 - Curve25519 ECDH
+	X25519 Curve = iota + 1
+	// P256 - NIST P-256 ECDH
+	P256
+	// P384 - NIST P-384 ECDH, the key exchange of version 2 peers
+	P384
+)
+
+// Compression - an algorithm payloads can be compressed with, the client and server use the first one in the server's
+// list that they both support
+type Compression uint8
+
+const (
+	// Zstd - Zstandard, the best ratio for its speed
+	Zstd Compression = iota + 1
+	// Snappy - Snappy, the fastest with a lower ratio
+	Snappy
+	// Gzip - gzip, for peers that only have the standard library
+	Gzip
+)
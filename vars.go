@@ -2,21 +2,55 @@ package ipc
 
 import "time"
 
-const version = 2 // ipc package version
+const (
+	version       = 3 // newest protocol version of the ipc package
+	minVersion    = 3 // oldest protocol version agreed on with the features
+	legacyVersion = 2 // version spoken before the handshake had features, see legacy.go
+
+	versionsPrefix = "versions=" // features entry listing the protocol versions an end speaks, newest first
+	compressPrefix = "compress=" // features entry listing the compression an end can use, in order of preference
+)
 
 const (
 	minMsgSize        = 1024
 	defaultMaxMsgSize = 3145728 // 3Mb  - Maximum bytes allowed for each message
 	defaultRetryTimer = time.Duration(200 * time.Millisecond)
+	sendQueueSize     = 64     // number of messages that can be waiting to be sent to each client
+	streamWindow      = 262144 // 256Kb - data that can be sent to a stream before the receiver has to read it
+	streamChunkSize   = 32768  // 32Kb  - largest frame a stream is split into
+	acceptQueueSize   = 16     // channels that can be waiting for AcceptChannel, any more are refused
+
+	defaultHeartbeatMisses = 3
+	defaultOutboxSize      = 1024
+	reliableWindow         = 1024                  // messages that can be sent before waiting for the other end to acknowledge them
+	ackDelay               = 10 * time.Millisecond // how long received messages wait to be acknowledged, so one ack covers several
+	defaultCompressMin     = 512                   // payloads smaller than this aren't compressed
+	defaultShmSize         = 4194304               // 4Mb - shared memory for each direction
+	maxShmSize             = 1 << 30               // largest shared memory a client will map for each direction
+	shmHeaderSize          = 4096                  // start of each ring, where the positions are kept
+	maxFiles               = 64                    // descriptors that can be sent with one message
+	maxPendingFiles        = 4 * maxFiles          // descriptors received over shared memory that can be waiting for their message
+	maxFeaturesSize        = 65535                 // longest list of features a client can accept
+
+	dirClient = 0 // direction of encrypted frames sent by the client
+	dirServer = 1 // direction of encrypted frames sent by the server
+
+	defaultBackoffInitial    = 100 * time.Millisecond // ExponentialBackoff defaults
+	defaultBackoffMax        = 30 * time.Second
+	defaultBackoffMultiplier = 2
 )
 
 var (
+	defaultCipherSuites = []CipherSuite{AES256GCM, ChaCha20Poly1305}
+	defaultCurves       = []Curve{X25519, P256}
+
 	DefaultServerConfig = ServerConfig{
 		SocketBasePath:    defaultSocketBasePath,
 		Timeout:           0,
 		MaxMsgSize:        defaultMaxMsgSize,
 		Encryption:        true,
 		UnmaskPermissions: false,
+		Codec:             JSONCodec{},
 	}
 
 	DefaultClientConfig = ClientConfig{
@@ -25,5 +59,6 @@ var (
 		RetryTimer:     defaultRetryTimer,
 		MaxMsgSize:     defaultMaxMsgSize,
 		Encryption:     true,
+		Codec:          JSONCodec{},
 	}
 )